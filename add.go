@@ -16,6 +16,8 @@ func init() {
 
 		flags: flag.NewFlagSet("add", flag.ExitOnError),
 		run:   add(makeActualAnno),
+
+		complete: taskArgs(1),
 	}
 
 	cmd.flags.StringVar(&addParams.addWhen, "when", "", "when the task should be added (default now). format: "+timeFormat)
@@ -33,6 +35,8 @@ func init() {
 
 		flags: flag.NewFlagSet("add-est", flag.ExitOnError),
 		run:   add(makeEstimateAnno),
+
+		complete: taskArgs(1),
 	}
 
 	cmd.flags.StringVar(&addParams.addWhen, "when", "", "when the task should be added (default now). format: "+timeFormat)
@@ -84,7 +88,7 @@ func add(maker annoMaker) func(*command) {
 		if len(args) != 2 {
 			c.Usage(1)
 		}
-		task, err := defaultBackend.Load(args[0])
+		task, err := loadTask(c.ctx, args[0])
 		if err != nil {
 			c.Error(err)
 		}
@@ -103,7 +107,7 @@ func add(maker annoMaker) func(*command) {
 		}
 
 		ann := maker(when, dur)
-		if err := defaultBackend.AddAnnotation(task, ann); err != nil {
+		if err := defaultBackend.AddAnnotation(c.ctx, task, ann); err != nil {
 			c.Error(err)
 		}
 		task.Apply(ann)
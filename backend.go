@@ -1,41 +1,120 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"sort"
+	"strings"
 	"time"
 )
 
 type Backend interface {
-	Save(task *Task) (err error)
-	SetDescription(task *Task, desc string) (err error)
-	AddAnnotation(task *Task, a Annotation) (err error)
-	PopAnnotation(task *Task) (err error)
-	Load(name string) (task *Task, err error)
-	Start(name string) (err error)
-	Stop() (err error)
-	Status() (log *StartLog, err error)
-	Find(regex string, before, after time.Time) (tasks []*Task, err error)
-	Rename(oldn, newn string) (err error)
-	Remove(name string) (err error)
+	Save(ctx context.Context, task *Task) (err error)
+	SetDescription(ctx context.Context, task *Task, desc string) (err error)
+	AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error)
+	PopAnnotation(ctx context.Context, task *Task) (err error)
+	Load(ctx context.Context, name string) (task *Task, err error)
+	Start(ctx context.Context, name string) (err error)
+	Stop(ctx context.Context) (err error)
+	//StopTimer ends the running timer and adds the time spent as an
+	//annotation on its task in one operation. it returns a nil log if no
+	//timer is running, and the task with the annotation applied.
+	StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error)
+	Status(ctx context.Context) (log *StartLog, err error)
+	//Find returns the tasks matching regex with an annotation at or after
+	//before and before after. when both times are zero it returns every
+	//task matching regex, annotated or not.
+	Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error)
+	Rename(ctx context.Context, oldn, newn string) (err error)
+	Remove(ctx context.Context, name string) (err error)
 }
 
 var defaultBackend Backend
 
+// allTasks lists every task, including those with no annotations yet.
+func allTasks(ctx context.Context, b Backend) ([]*Task, error) {
+	return b.Find(ctx, "", time.Time{}, time.Time{})
+}
+
+// findsAll tells if the window given to Find asks for every task.
+func findsAll(before, after time.Time) bool {
+	return before.IsZero() && after.IsZero()
+}
+
+// annotatedIn tells if the task has an annotation in the window given to
+// Find, for backends that filter tasks themselves.
+func annotatedIn(t *Task, before, after time.Time) bool {
+	if findsAll(before, after) {
+		return true
+	}
+	for _, a := range t.Annotations {
+		if !a.When.Before(before) && a.When.Before(after) {
+			return true
+		}
+	}
+	return false
+}
+
 func loadBackend(c *Config) (err error) {
-	var b Backend
-	switch c.Backend {
-	case "mongo":
-		b, err = openMongo(c.MongoConfig)
-		if err == nil {
-			defaultBackend = b
+	b, err := openBackend(c)
+	if err == nil {
+		if m, ok := b.(migrator); ok {
+			err = checkSchema(context.Background(), m)
+		} else if m, ok := asMirror(b); ok {
+			err = m.checkSchemas(context.Background())
 		}
-	case "rpc":
-		b, err = openRPC(c.RPCConfig)
-		if err == nil {
-			defaultBackend = b
+	}
+
+	//with offline mode an unreachable backend is served from the replica
+	if c.Offline != nil {
+		b, err = openOffline(c.Offline, b, err)
+	}
+	if err == nil {
+		defaultBackend = b
+	}
+	return
+}
+
+// backendType is a kind of backend. each kind registers itself into
+// backendTypes under the name used for Backend in the config.
+type backendType struct {
+	section string                                  //key of its settings in the config, like "MongoConfig"
+	config  func() interface{}                      //new settings to decode the section into
+	open    func(conf interface{}) (Backend, error) //connects with the decoded settings
+}
+
+var backendTypes = map[string]*backendType{}
+
+// sectionType finds the backend type with the section key, ignoring case as
+// json does.
+func sectionType(key string) (name string, t *backendType) {
+	for name, t = range backendTypes {
+		if strings.EqualFold(t.section, key) {
+			return
 		}
-	default:
-		err = fmt.Errorf("unknown backend: %q", c.Backend)
 	}
+	return "", nil
+}
+
+// backendNames lists the registered backends in order.
+func backendNames() (names []string) {
+	for name := range backendTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	return
 }
+
+// openBackend connects to the backend in the config without checking the
+// schema of its data. a backend without a section opens with the defaults.
+func openBackend(c *Config) (b Backend, err error) {
+	t, ok := backendTypes[c.Backend]
+	if !ok {
+		err = errorf(ErrInvalidArgument, "unknown backend: %q", c.Backend)
+		return
+	}
+	conf, ok := c.Sections[t.section]
+	if !ok {
+		conf = t.config()
+	}
+	return t.open(conf)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testBackend runs the checks every backend has to pass on an empty backend.
+func testBackend(t *testing.T, b Backend) {
+	t.Run("tasks", func(t *testing.T) { testBackendTasks(t, b) })
+	t.Run("timer", func(t *testing.T) { testBackendTimer(t, b) })
+	t.Run("timer on a removed task", func(t *testing.T) { testBackendTimerRemoved(t, b) })
+	if n, ok := b.(namespacer); ok {
+		t.Run("namespaces", func(t *testing.T) { testBackendNamespaces(t, n) })
+	}
+	if m, ok := b.(migrator); ok {
+		t.Run("schema", func(t *testing.T) { testBackendSchema(t, m) })
+	}
+}
+
+var testNow = time.Now()
+
+func testSave(t *testing.T, b Backend, name string) *Task {
+	task := &Task{Name: name}
+	task.Apply(Annotation{When: testNow.Add(-48 * time.Hour), EstimateDelta: time.Hour})
+	if err := b.Save(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func testFind(t *testing.T, b Backend, regex string, low, high time.Time) (names []string) {
+	tasks, err := b.Find(context.Background(), regex, low, high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		names = append(names, task.Name)
+	}
+	return
+}
+
+func testBackendTasks(t *testing.T, b Backend) {
+	ctx := context.Background()
+	testSave(t, b, "a")
+	testSave(t, b, "b")
+	if dup := testSave(t, b, "a"); dup.Name != "a1" {
+		t.Fatalf("saving a second a named it %q", dup.Name)
+	}
+
+	task, err := b.Load(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Estimate != time.Hour || len(task.Annotations) != 1 {
+		t.Fatalf("loaded %+v", task)
+	}
+	if _, err := b.Load(ctx, "missing"); !isCode(err, ErrNotFound) {
+		t.Fatalf("loading a missing task: %v", err)
+	}
+
+	if err := b.AddAnnotation(ctx, task, Annotation{When: testNow, ActualDelta: time.Minute, Focus: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetDescription(ctx, &Task{Name: "a"}, "stale"); !isCode(err, ErrConflict) {
+		t.Fatalf("changing a stale task: %v", err)
+	}
+	if task, _ = b.Load(ctx, "a"); task.Actual != time.Minute || task.Sessions() != 1 {
+		t.Fatalf("after adding an annotation %+v", task)
+	}
+
+	if names := testFind(t, b, "", testNow.Add(-time.Hour), testNow.Add(time.Hour)); len(names) != 1 || names[0] != "a" {
+		t.Fatalf("found %q in the last hour", names)
+	}
+	if names := testFind(t, b, "^b", time.Time{}, testNow.AddDate(1, 0, 0)); len(names) != 1 {
+		t.Fatalf("found %q matching ^b", names)
+	}
+
+	//tasks without annotations only turn up when asking for every task
+	if err := b.Save(ctx, &Task{Name: "bare"}); err != nil {
+		t.Fatal(err)
+	}
+	if names := testFind(t, b, "", time.Time{}, testNow.AddDate(1, 0, 0)); len(names) != 3 {
+		t.Fatalf("found %q with annotations", names)
+	}
+	if names := testFind(t, b, "", time.Time{}, time.Time{}); len(names) != 4 {
+		t.Fatalf("found %q of every task", names)
+	}
+	if names := testFind(t, b, "^ba", time.Time{}, time.Time{}); len(names) != 1 || names[0] != "bare" {
+		t.Fatalf("found %q of every task matching ^ba", names)
+	}
+
+	if err := b.Rename(ctx, "a", "b"); !isCode(err, ErrConflict) {
+		t.Fatalf("renaming over a task: %v", err)
+	}
+	if err := b.Rename(ctx, "a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if names := testFind(t, b, "", testNow.Add(-time.Hour), testNow.Add(time.Hour)); len(names) != 1 || names[0] != "c" {
+		t.Fatalf("found %q after renaming", names)
+	}
+
+	task, _ = b.Load(ctx, "c")
+	if err := b.PopAnnotation(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if names := testFind(t, b, "", testNow.Add(-time.Hour), testNow.Add(time.Hour)); len(names) != 0 {
+		t.Fatalf("found %q after undoing", names)
+	}
+
+	for _, name := range []string{"a1", "b", "bare", "c"} {
+		if err := b.Remove(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := testFind(t, b, "", time.Time{}, testNow.AddDate(1, 0, 0)); len(names) != 0 {
+		t.Fatalf("found %q after removing everything", names)
+	}
+}
+
+func testBackendTimer(t *testing.T, b Backend) {
+	ctx := context.Background()
+	testSave(t, b, "timed")
+	defer b.Remove(ctx, "timed")
+
+	if log, task, err := b.StopTimer(ctx, time.Now()); log != nil || task != nil || err != nil {
+		t.Fatalf("stopping without a timer: %v %v %v", log, task, err)
+	}
+	if err := b.Start(ctx, "timed"); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := b.Status(ctx); err != nil || log == nil || log.Name != "timed" {
+		t.Fatalf("status %v %v", log, err)
+	}
+	log, task, err := b.StopTimer(ctx, time.Now().Add(time.Minute))
+	if err != nil || log == nil || task.Actual < time.Minute {
+		t.Fatalf("stopping the timer: %v %v %v", log, task, err)
+	}
+	if log, err := b.Status(ctx); err != nil || log != nil {
+		t.Fatalf("status after stopping %v %v", log, err)
+	}
+}
+
+// a timer left on a removed task has to stop anyway, or nothing else can
+// be started.
+func testBackendTimerRemoved(t *testing.T, b Backend) {
+	ctx := context.Background()
+	testSave(t, b, "gone")
+	if err := b.Start(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	log, task, err := b.StopTimer(ctx, time.Now())
+	if !isCode(err, ErrNotFound) || log == nil || log.Name != "gone" || task != nil {
+		t.Fatalf("stopping the timer on a removed task: %v %v %v", log, task, err)
+	}
+	if log, err := b.Status(ctx); err != nil || log != nil {
+		t.Fatalf("timer still running after stopping: %v %v", log, err)
+	}
+}
+
+func testBackendNamespaces(t *testing.T, n namespacer) {
+	ctx := context.Background()
+	alice, bob := n.Namespace("alice"), n.Namespace("bob")
+	testSave(t, alice, "hers")
+	if names := testFind(t, bob, "", time.Time{}, testNow.AddDate(1, 0, 0)); len(names) != 0 {
+		t.Fatalf("bob sees %q", names)
+	}
+	if _, err := bob.Load(ctx, "hers"); !isCode(err, ErrNotFound) {
+		t.Fatalf("bob loading alice's task: %v", err)
+	}
+}
+
+func testBackendSchema(t *testing.T, m migrator) {
+	ctx := context.Background()
+	if v, err := m.schema(ctx); err != nil || v != currentSchema() {
+		t.Fatalf("schema %d %v", v, err)
+	}
+	next := migration{currentSchema() + 1, "recompute the totals again", recomputeTotals}
+	if err := m.migrate(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.schema(ctx); err != nil || v != next.version {
+		t.Fatalf("schema after migrating %d %v", v, err)
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// BoltConfig is for a single user backend kept in a local database file.
+// only one est can have the file open at a time, so it's opened for each
+// transaction and closed right after.
+type BoltConfig struct {
+	Path    string   `json:",omitempty"` //database file. default $HOME/.est.db
+	Timeout Duration `json:",omitempty"` //how long to wait for another est to finish with the file. default 5s
+}
+
+func (c *BoltConfig) validate() (problems []string) {
+	if c.Timeout < 0 {
+		problems = append(problems, "Timeout can't be negative")
+	}
+	return
+}
+
+const defaultBoltTimeout = 5 * time.Second
+
+// the database has a bucket per namespace holding buckets for the tasks, the
+// annotation time index and the timer, and a meta bucket for the schema
+// version.
+var (
+	boltMeta    = []byte("meta")
+	boltTasks   = []byte("tasks")
+	boltWhen    = []byte("when")
+	boltTimer   = []byte("timer")
+	boltDefault = "default"
+)
+
+func init() {
+	backendTypes["bolt"] = &backendType{
+		section: "BoltConfig",
+		config:  func() interface{} { return &BoltConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openBolt(conf.(*BoltConfig)) },
+	}
+}
+
+func openBolt(c *BoltConfig) (b Backend, err error) {
+	path := c.Path
+	if path == "" {
+		path = os.ExpandEnv("$HOME/.est.db")
+	}
+	timeout := time.Duration(c.Timeout)
+	if timeout <= 0 {
+		timeout = defaultBoltTimeout
+	}
+
+	bb := &boltBackend{path: path, timeout: timeout, ns: []byte(boltDefault)}
+	err = bb.tx(true, func(tx *bolt.Tx) (err error) {
+		//est had schema versions before this backend, so new files are current
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return
+		}
+		if meta.Get([]byte("schema")) == nil {
+			err = meta.Put([]byte("schema"), []byte(strconv.Itoa(currentSchema())))
+			if err != nil {
+				return
+			}
+		}
+		return createBoltNamespace(tx, boltDefault)
+	})
+	if err != nil {
+		return
+	}
+
+	b = bb
+	return
+}
+
+func createBoltNamespace(tx *bolt.Tx, name string) (err error) {
+	ns, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return
+	}
+	for _, sub := range [][]byte{boltTasks, boltWhen, boltTimer} {
+		if _, err = ns.CreateBucketIfNotExists(sub); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type boltBackend struct {
+	path    string
+	timeout time.Duration
+	ns      []byte
+}
+
+// Namespace returns a backend with its own buckets for the user.
+func (b *boltBackend) Namespace(user string) Backend {
+	name := "user." + user
+
+	//only write when the buckets are missing. if creating them fails, every
+	//call on the namespace reports it.
+	var exists bool
+	b.tx(false, func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(name)) != nil
+		return nil
+	})
+	if !exists {
+		b.tx(true, func(tx *bolt.Tx) error {
+			return createBoltNamespace(tx, name)
+		})
+	}
+	return &boltBackend{path: b.path, timeout: b.timeout, ns: []byte(name)}
+}
+
+//
+// transactions
+//
+
+// tx runs fn in a transaction on the file, holding its lock only for as long
+// as the transaction, so long running commands like daemon and ui don't lock
+// every other est out.
+func (b *boltBackend) tx(writable bool, fn func(tx *bolt.Tx) error) (err error) {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: b.timeout})
+	if err == bolt.ErrTimeout {
+		err = errorf(ErrUnavailable, "%s is in use by another est", b.path)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	if writable {
+		return db.Update(fn)
+	}
+	return db.View(fn)
+}
+
+func (b *boltBackend) namespace(tx *bolt.Tx) (ns *bolt.Bucket, err error) {
+	if ns = tx.Bucket(b.ns); ns == nil {
+		err = fmt.Errorf("missing bucket for namespace %s", b.ns)
+	}
+	return
+}
+
+func (b *boltBackend) view(ctx context.Context, fn func(ns *bolt.Bucket) error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.tx(false, func(tx *bolt.Tx) (err error) {
+		ns, err := b.namespace(tx)
+		if err != nil {
+			return
+		}
+		return fn(ns)
+	})
+	return
+}
+
+func (b *boltBackend) update(ctx context.Context, fn func(ns *bolt.Bucket) error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.tx(true, func(tx *bolt.Tx) (err error) {
+		ns, err := b.namespace(tx)
+		if err != nil {
+			return
+		}
+		return fn(ns)
+	})
+	return
+}
+
+//
+// tasks and the annotation time index
+//
+
+func getBoltTask(ns *bolt.Bucket, name string) (task *Task, err error) {
+	data := ns.Bucket(boltTasks).Get([]byte(name))
+	if data == nil {
+		err = errorf(ErrNotFound, "task %q not found", name)
+		return
+	}
+	task = new(Task)
+	err = json.Unmarshal(data, task)
+	return
+}
+
+func putBoltTask(ns *bolt.Bucket, task *Task) (err error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return
+	}
+	err = ns.Bucket(boltTasks).Put([]byte(task.Name), data)
+	return
+}
+
+// getBoltRevision loads the task for a change, failing if it moved past the
+// revision the caller loaded.
+func getBoltRevision(ns *bolt.Bucket, task *Task) (stored *Task, err error) {
+	if stored, err = getBoltTask(ns, task.Name); err != nil {
+		return
+	}
+	if stored.Revision != task.Revision {
+		err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+	}
+	return
+}
+
+// timeKey orders times as bytes.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(unixNanos(t))^(1<<63))
+	return k
+}
+
+// whenKey is the index key for the i'th annotation of a task: the time of
+// the annotation, the task name, a zero byte and i.
+func whenKey(a Annotation, name string, i int) []byte {
+	k := append(timeKey(a.When), name...)
+	k = append(k, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(k[len(k)-4:], uint32(i))
+	return k
+}
+
+func whenKeyName(k []byte) string {
+	return string(k[8 : len(k)-5])
+}
+
+func indexBoltTask(ns *bolt.Bucket, task *Task) (err error) {
+	when := ns.Bucket(boltWhen)
+	for i, a := range task.Annotations {
+		if err = when.Put(whenKey(a, task.Name, i), nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func unindexBoltTask(ns *bolt.Bucket, task *Task) (err error) {
+	when := ns.Bucket(boltWhen)
+	for i, a := range task.Annotations {
+		if err = when.Delete(whenKey(a, task.Name, i)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//
+// Backend
+//
+
+func (b *boltBackend) Save(ctx context.Context, task *Task) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		//while theres a task with this name, increment the number on the end of it
+		tasks := ns.Bucket(boltTasks)
+		candidate := task.Name
+		for i := 1; tasks.Get([]byte(candidate)) != nil; i++ {
+			candidate = fmt.Sprintf("%s%d", task.Name, i)
+		}
+		task.Name = candidate
+
+		if err = putBoltTask(ns, task); err != nil {
+			return
+		}
+		return indexBoltTask(ns, task)
+	})
+	return
+}
+
+func (b *boltBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		stored, err := getBoltRevision(ns, task)
+		if err != nil {
+			return
+		}
+		stored.Description = desc
+		stored.Revision++
+		return putBoltTask(ns, stored)
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (b *boltBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		stored, err := getBoltRevision(ns, task)
+		if err != nil {
+			return
+		}
+		stored.Apply(a)
+		stored.Revision++
+		if err = putBoltTask(ns, stored); err != nil {
+			return
+		}
+		return ns.Bucket(boltWhen).Put(whenKey(a, stored.Name, len(stored.Annotations)-1), nil)
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (b *boltBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	if len(task.Annotations) == 0 {
+		err = errorf(ErrInvalidArgument, "no annotations to undo")
+		return
+	}
+
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		stored, err := getBoltRevision(ns, task)
+		if err != nil {
+			return
+		}
+		i := len(stored.Annotations) - 1
+		a := stored.Annotations[i]
+		stored.Annotations = stored.Annotations[:i]
+		stored.Estimate -= a.EstimateDelta
+		stored.Actual -= a.ActualDelta
+		stored.Revision++
+		if err = putBoltTask(ns, stored); err != nil {
+			return
+		}
+		return ns.Bucket(boltWhen).Delete(whenKey(a, stored.Name, i))
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (b *boltBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	err = b.view(ctx, func(ns *bolt.Bucket) (err error) {
+		task, err = getBoltTask(ns, name)
+		return
+	})
+	return
+}
+
+func (b *boltBackend) Start(ctx context.Context, name string) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		data, err := json.Marshal(StartLog{
+			Name: name,
+			When: time.Now(),
+		})
+		if err != nil {
+			return
+		}
+		return ns.Bucket(boltTimer).Put(boltTimer, data)
+	})
+	return
+}
+
+func (b *boltBackend) Stop(ctx context.Context) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) error {
+		return ns.Bucket(boltTimer).Delete(boltTimer)
+	})
+	return
+}
+
+func getBoltTimer(ns *bolt.Bucket) (log *StartLog, err error) {
+	data := ns.Bucket(boltTimer).Get(boltTimer)
+	if data == nil {
+		return
+	}
+	log = new(StartLog)
+	err = json.Unmarshal(data, log)
+	return
+}
+
+// StopTimer removes the timer and records the time in one transaction.
+func (b *boltBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	var missing bool
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		if log, err = getBoltTimer(ns); err != nil || log == nil {
+			return
+		}
+		if err = ns.Bucket(boltTimer).Delete(boltTimer); err != nil {
+			return
+		}
+		if task, err = getBoltTask(ns, log.Name); isCode(err, ErrNotFound) {
+			//the task is gone. still stop the timer.
+			missing = true
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		a := log.Annotation(when)
+		task.Apply(a)
+		task.Revision++
+		if err = putBoltTask(ns, task); err != nil {
+			return
+		}
+		return ns.Bucket(boltWhen).Put(whenKey(a, task.Name, len(task.Annotations)-1), nil)
+	})
+	switch {
+	case err != nil:
+		log, task = nil, nil
+	case missing:
+		task = nil
+		err = errorf(ErrNotFound, "task %q not found", log.Name)
+	}
+	return
+}
+
+func (b *boltBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	err = b.view(ctx, func(ns *bolt.Bucket) (err error) {
+		log, err = getBoltTimer(ns)
+		return
+	})
+	return
+}
+
+// Find walks the annotation time index over the window instead of loading
+// every task, unless every task is asked for.
+func (b *boltBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "invalid regex: %s", err)
+		return
+	}
+
+	err = b.view(ctx, func(ns *bolt.Bucket) (err error) {
+		tasks = nil
+		if findsAll(before, after) {
+			return ns.Bucket(boltTasks).ForEach(func(k, v []byte) (err error) {
+				if !re.Match(k) {
+					return
+				}
+				task := new(Task)
+				if err = json.Unmarshal(v, task); err == nil {
+					tasks = append(tasks, task)
+				}
+				return
+			})
+		}
+
+		seen := map[string]bool{}
+		end := timeKey(after)
+		c := ns.Bucket(boltWhen).Cursor()
+		for k, _ := c.Seek(timeKey(before)); k != nil && bytes.Compare(k[:8], end) < 0; k, _ = c.Next() {
+			name := whenKeyName(k)
+			if seen[name] || !re.MatchString(name) {
+				continue
+			}
+			seen[name] = true
+
+			var task *Task
+			if task, err = getBoltTask(ns, name); err != nil {
+				return
+			}
+			tasks = append(tasks, task)
+		}
+		return
+	})
+	return
+}
+
+func (b *boltBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		task, err := getBoltTask(ns, oldn)
+		if err != nil {
+			return
+		}
+		if ns.Bucket(boltTasks).Get([]byte(newn)) != nil {
+			return errorf(ErrConflict, "task %q already exists", newn)
+		}
+
+		if err = unindexBoltTask(ns, task); err != nil {
+			return
+		}
+		if err = ns.Bucket(boltTasks).Delete([]byte(oldn)); err != nil {
+			return
+		}
+		task.Name = newn
+		if err = putBoltTask(ns, task); err != nil {
+			return
+		}
+		return indexBoltTask(ns, task)
+	})
+	return
+}
+
+func (b *boltBackend) Remove(ctx context.Context, name string) (err error) {
+	err = b.update(ctx, func(ns *bolt.Bucket) (err error) {
+		task, err := getBoltTask(ns, name)
+		if err != nil {
+			return
+		}
+		if err = unindexBoltTask(ns, task); err != nil {
+			return
+		}
+		return ns.Bucket(boltTasks).Delete([]byte(name))
+	})
+	return
+}
+
+//
+// schema versions
+//
+
+func (b *boltBackend) schema(ctx context.Context) (version int, err error) {
+	err = b.tx(false, func(tx *bolt.Tx) (err error) {
+		version, err = strconv.Atoi(string(tx.Bucket(boltMeta).Get([]byte("schema"))))
+		return
+	})
+	return
+}
+
+// migrate rewrites the tasks of every namespace and rebuilds their indexes in
+// one transaction.
+func (b *boltBackend) migrate(ctx context.Context, m migration) (err error) {
+	err = b.tx(true, func(tx *bolt.Tx) (err error) {
+		//buckets can't change while they're iterated, so collect first
+		var names [][]byte
+		err = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.Equal(name, boltMeta) {
+				names = append(names, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		for _, name := range names {
+			if err = migrateBoltNamespace(tx.Bucket(name), m); err != nil {
+				return
+			}
+		}
+		return tx.Bucket(boltMeta).Put([]byte("schema"), []byte(strconv.Itoa(m.version)))
+	})
+	return
+}
+
+func migrateBoltNamespace(ns *bolt.Bucket, m migration) (err error) {
+	tasks := ns.Bucket(boltTasks)
+	stored := map[string][]byte{}
+	err = tasks.ForEach(func(k, v []byte) error {
+		stored[string(k)] = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if err = ns.DeleteBucket(boltWhen); err != nil {
+		return
+	}
+	if _, err = ns.CreateBucket(boltWhen); err != nil {
+		return
+	}
+
+	for name, data := range stored {
+		var t doc
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err = dec.Decode(&t); err != nil {
+			return
+		}
+		if err = m.task(t); err != nil {
+			return
+		}
+		if data, err = json.Marshal(t); err != nil {
+			return
+		}
+		if err = tasks.Put([]byte(name), data); err != nil {
+			return
+		}
+
+		task := new(Task)
+		if err = json.Unmarshal(data, task); err != nil {
+			return
+		}
+		if err = indexBoltTask(ns, task); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBolt(t *testing.T) {
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(t.TempDir(), "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+func TestBoltSharedBetweenTransactions(t *testing.T) {
+	c := &BoltConfig{Path: filepath.Join(t.TempDir(), "est.db"), Timeout: Duration(100 * time.Millisecond)}
+	ctx := context.Background()
+
+	//a long running est keeps its backend, but not the file
+	running, err := openBolt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := running.Status(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openBolt(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(ctx, &Task{Name: "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := running.Load(ctx, "shared"); err != nil {
+		t.Fatal(err)
+	}
+}
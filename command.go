@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -12,9 +13,17 @@ type command struct {
 	usage string //usage
 
 	needsBackend bool
+	loadsConfig  bool //reports problems loading the config instead of failing
+	hidden       bool //left out of the usage
+
+	//complete lists candidates for the next argument given the ones before
+	//it. nil completes nothing.
+	complete func(args []string, prefix string) []string
 
 	flags *flag.FlagSet
 	run   func(*command)
+
+	ctx context.Context //context for backend calls
 }
 
 func (c *command) Usage(status int) {
@@ -25,7 +34,10 @@ func (c *command) Usage(status int) {
 
 func (c *command) Error(err error) {
 	fmt.Fprintf(os.Stderr, "error: %s\n", err)
-	os.Exit(1)
+	if hint := errorHint(err); hint != "" {
+		fmt.Fprintf(os.Stderr, "%s\n", hint)
+	}
+	os.Exit(errorExit(err))
 }
 
 var commands = map[string]*command{}
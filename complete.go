@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmd := &command{
+		short: "prints a shell script completing est commands and task names",
+		long:  "Prints a script for bash, zsh or fish that completes est commands, their flags and task names. Load it from the shell's startup file, for example with 'source <(est completion bash)' in ~/.bashrc. Task names come from the backend, and nothing is completed if it takes more than a second to answer.",
+		usage: "completion <bash | zsh | fish>",
+
+		needsBackend: false,
+
+		flags: flag.NewFlagSet("completion", flag.ExitOnError),
+		run:   completion,
+
+		complete: wordArgs("bash", "zsh", "fish"),
+	}
+
+	commands["completion"] = cmd
+}
+
+// the scripts pass the words typed so far to __complete, ending with the one
+// being completed, and offer the lines it prints.
+var completionScripts = map[string]string{
+	"bash": `_est() {
+	local IFS=$'\n'
+	COMPREPLY=($(est __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _est est
+`,
+	"zsh": `#compdef est
+_est() {
+	local -a candidates
+	candidates=("${(@f)$(est __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	candidates=(${candidates:#})
+	compadd -a candidates
+}
+compdef _est est
+`,
+	"fish": `function __est_complete
+	set -l words (commandline -opc) (commandline -ct)
+	est __complete $words[2..-1] 2>/dev/null
+end
+complete -c est -f -a '(__est_complete)'
+`,
+}
+
+func completion(c *command) {
+	args := c.flags.Args()
+	if len(args) != 1 {
+		c.Usage(1)
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		c.Error(errorf(ErrInvalidArgument, "no completion for %q. use bash, zsh or fish", args[0]))
+	}
+	fmt.Print(script)
+}
+
+func init() {
+	cmd := &command{
+		short: "completes the words typed for the shell",
+		long:  "Used by the completion scripts. Prints the candidates for the last word given, one per line, taking the words before it as the command line typed so far.",
+		usage: "__complete [words ...] <word>",
+
+		//the backend is only opened to complete task names
+		needsBackend: false,
+		loadsConfig:  true,
+		hidden:       true,
+
+		flags: flag.NewFlagSet("__complete", flag.ContinueOnError),
+		run:   complete,
+	}
+
+	cmd.flags.SetOutput(discard{})
+
+	commands["__complete"] = cmd
+}
+
+// how long completing task names waits on the backend before giving up
+const completeTimeout = time.Second
+
+func complete(c *command) {
+	//the words aren't flags of __complete, so take them as typed
+	i := indexOf(os.Args, "__complete")
+	if i < 0 || i+1 == len(os.Args) {
+		return
+	}
+	words := os.Args[i+1:]
+	prefix, words := words[len(words)-1], words[:len(words)-1]
+
+	var candidates []string
+	defer func() {
+		sort.Strings(candidates)
+		for _, w := range candidates {
+			if strings.HasPrefix(w, prefix) {
+				fmt.Println(w)
+			}
+		}
+	}()
+
+	//skip the flags of est itself, using the config they name
+	global := flag.NewFlagSet("est", flag.ContinueOnError)
+	path := global.String("config", configPath, "")
+	profile := global.String("profile", configProfile, "")
+	global.SetOutput(discard{})
+	if global.Parse(words) != nil {
+		return
+	}
+	words = global.Args()
+	if *path != configPath || *profile != configProfile {
+		configPath, configProfile = *path, *profile
+		loadConfig(configPath, false)
+	}
+
+	if len(words) == 0 {
+		if strings.HasPrefix(prefix, "-") {
+			candidates = flagNames(global)
+		} else {
+			candidates = commandNames()
+		}
+		return
+	}
+
+	cmd, ok := commands[words[0]]
+	if !ok {
+		return
+	}
+	if strings.HasPrefix(prefix, "-") {
+		candidates = flagNames(cmd.flags)
+		return
+	}
+
+	//find the arguments given so far, leaving the value of a flag to the
+	//shell
+	args := words[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name := strings.TrimLeft(args[0], "-")
+		args = args[1:]
+		if strings.Contains(name, "=") || name == "" {
+			continue
+		}
+		if f := cmd.flags.Lookup(name); f != nil && !isBoolFlag(f) {
+			if len(args) == 0 {
+				return
+			}
+			args = args[1:]
+		}
+	}
+	if cmd.complete != nil {
+		candidates = cmd.complete(args, prefix)
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func indexOf(words []string, w string) int {
+	for i := range words {
+		if words[i] == w {
+			return i
+		}
+	}
+	return -1
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func flagNames(fs *flag.FlagSet) (names []string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return
+}
+
+// commandNames lists the commands shown to users in order.
+func commandNames() (names []string) {
+	for name, cmd := range commands {
+		if !cmd.hidden {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// taskArgs completes task names for the first n arguments.
+func taskArgs(n int) func(args []string, prefix string) []string {
+	return func(args []string, prefix string) []string {
+		if len(args) >= n {
+			return nil
+		}
+		return taskNames(prefix)
+	}
+}
+
+// wordArgs completes the first argument from a list of words.
+func wordArgs(words ...string) func(args []string, prefix string) []string {
+	return func(args []string, prefix string) []string {
+		if len(args) > 0 {
+			return nil
+		}
+		return words
+	}
+}
+
+// taskNames asks the backend for the names of the tasks starting with the
+// prefix. a backend that is slow to answer completes nothing, rather than
+// holding up the shell.
+func taskNames(prefix string) (names []string) {
+	found := make(chan []string, 1)
+	go func() {
+		var names []string
+		if err := loadBackend(defaultConfig); err == nil {
+			//zero times find every task, even ones not worked on yet
+			tasks, _ := defaultBackend.Find(context.Background(), "^"+regexp.QuoteMeta(prefix), time.Time{}, time.Time{})
+			for _, t := range tasks {
+				names = append(names, t.Name)
+			}
+		}
+		found <- names
+	}()
+
+	select {
+	case names = <-found:
+	case <-time.After(completeTimeout):
+	}
+	return
+}
@@ -1,46 +1,651 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Backend     string
-	MongoConfig *MongoConfig `json:",omitempty"`
-	RPCConfig   *RPCConfig   `json:",omitempty"`
+	Backend  string
+	Sections map[string]interface{} //settings for each kind of backend, keyed like "MongoConfig"
+
+	Offline *OfflineConfig //queue changes while the backend is unreachable
+	Timer   *TimerConfig   //catch timers left running
+	Daemon  *DaemonConfig  //reminders sent by est daemon
+}
+
+// the sections sit beside Backend in the json, so a config is decoded by
+// hand. keys match without case like they do for structs.
+
+func (c Config) fields() map[string]interface{} {
+	m := map[string]interface{}{"Backend": c.Backend}
+	for key, section := range c.Sections {
+		m[key] = section
+	}
+	if c.Offline != nil {
+		m["Offline"] = c.Offline
+	}
+	if c.Timer != nil {
+		m["Timer"] = c.Timer
+	}
+	if c.Daemon != nil {
+		m["Daemon"] = c.Daemon
+	}
+	return m
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.fields())
+}
+
+func (c *Config) UnmarshalJSON(b []byte) (err error) {
+	var m map[string]json.RawMessage
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	return c.decode(m)
+}
+
+// decode reads the fields over what's in the config already, so a profile
+// keeps the settings it leaves out. sections of unknown backends are kept as
+// they are.
+func (c *Config) decode(m map[string]json.RawMessage) (err error) {
+	for key, raw := range m {
+		switch {
+		case strings.EqualFold(key, "Backend"):
+			err = json.Unmarshal(raw, &c.Backend)
+
+		case strings.EqualFold(key, "Offline"):
+			if c.Offline == nil {
+				c.Offline = &OfflineConfig{}
+			}
+			err = json.Unmarshal(raw, c.Offline)
+
+		case strings.EqualFold(key, "Timer"):
+			if c.Timer == nil {
+				c.Timer = &TimerConfig{}
+			}
+			err = json.Unmarshal(raw, c.Timer)
+
+		case strings.EqualFold(key, "Daemon"):
+			if c.Daemon == nil {
+				c.Daemon = &DaemonConfig{}
+			}
+			err = json.Unmarshal(raw, c.Daemon)
+
+		default:
+			if c.Sections == nil {
+				c.Sections = map[string]interface{}{}
+			}
+			_, t := sectionType(key)
+			if t == nil {
+				c.Sections[key] = raw
+				continue
+			}
+			section, ok := c.Sections[t.section]
+			if !ok {
+				section = t.config()
+			}
+			if err = json.Unmarshal(raw, section); err == nil {
+				c.Sections[t.section] = section
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return
+}
+
+// Duration is a time.Duration written as a string like "1m30s" in the config
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	x, err := time.ParseDuration(s)
+	*d = Duration(x)
+	return
 }
 
 var defaultConfig = &Config{
 	Backend: "mongo",
-	MongoConfig: &MongoConfig{
-		Host:     "localhost",
-		Database: "est",
+	Sections: map[string]interface{}{
+		"MongoConfig": &MongoConfig{
+			Host:     "localhost",
+			Database: "est",
+		},
 	},
 }
 
+// configFile is the layout of the config file: a config, and named profiles
+// holding settings layered over it.
+type configFile struct {
+	Config
+	Profile  string                     //profile used when none is chosen
+	Profiles map[string]json.RawMessage //named configs
+}
+
+func (f configFile) MarshalJSON() ([]byte, error) {
+	m := f.Config.fields()
+	if f.Profile != "" {
+		m["Profile"] = f.Profile
+	}
+	if len(f.Profiles) > 0 {
+		m["Profiles"] = f.Profiles
+	}
+	return json.Marshal(m)
+}
+
+func (f *configFile) UnmarshalJSON(b []byte) (err error) {
+	var m map[string]json.RawMessage
+	if err = json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	for key, raw := range m {
+		switch {
+		case strings.EqualFold(key, "Profile"):
+			err = json.Unmarshal(raw, &f.Profile)
+		case strings.EqualFold(key, "Profiles"):
+			err = json.Unmarshal(raw, &f.Profiles)
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+		delete(m, key)
+	}
+	return f.Config.decode(m)
+}
+
+var (
+	configProfile string            //the profile in use
+	configSources map[string]string //where each setting came from
+	configErr     error             //why the config didn't load, for commands that report it
+)
+
+// defaultConfigPath is $XDG_CONFIG_HOME/est/config.json, unless only the
+// older $HOME/.est exists.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = os.ExpandEnv("$HOME/.config")
+	}
+	path := filepath.Join(dir, "est", "config.json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(os.ExpandEnv("$HOME/.est")); err == nil {
+			return os.ExpandEnv("$HOME/.est")
+		}
+	}
+	return path
+}
+
+// loadConfig reads the config file into the default config, then layers the
+// profile and the environment variables over it. without a file the built
+// in config is used, quietly if the file is the default one.
+func loadConfig(path string, isDefault bool) (err error) {
+	configSources = map[string]string{}
+	note := func(c *Config, source string) {
+		for _, s := range settings() {
+			if s.isSet(c) {
+				configSources[s.key] = source
+			}
+		}
+	}
+
+	var file configFile
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("error parsing config file: %s", err)
+		}
+		defaultConfig = &file.Config
+		note(defaultConfig, "file "+path)
+
+		if info, serr := os.Stat(path); serr == nil && info.Mode().Perm()&0004 != 0 && plainSecrets(defaultConfig) {
+			fmt.Fprintf(os.Stderr, "warning: %s holds passwords and can be read by anyone. chmod 600 it\n", path)
+		}
+
+	case isDefault:
+		note(defaultConfig, "default")
+
+	default:
+		fmt.Fprintf(os.Stderr, "%s.\nusing default configuration.\n\n", err)
+		note(defaultConfig, "default")
+	}
+
+	if configProfile == "" {
+		configProfile = file.Profile
+	}
+	if configProfile != "" {
+		raw, ok := file.Profiles[configProfile]
+		if !ok {
+			return errorf(ErrInvalidArgument, "unknown profile %q", configProfile)
+		}
+		var layer Config
+		if err = json.Unmarshal(raw, &layer); err != nil {
+			return fmt.Errorf("error parsing profile %q: %s", configProfile, err)
+		}
+		note(&layer, "profile "+configProfile)
+
+		//decoding again over the config keeps what the profile leaves out
+		json.Unmarshal(raw, defaultConfig)
+	}
+
+	for _, s := range settings() {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err = s.set(defaultConfig, value); err != nil {
+				return fmt.Errorf("%s: %w", s.env, err)
+			}
+			configSources[s.key] = "env " + s.env
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the config file. a missing file reads as empty.
+func readConfigFile(path string) (file *configFile, err error) {
+	file = &configFile{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, file)
+	}
+	return
+}
+
+// editConfig changes the settings in the config file, in the profile in use
+// if there is one.
+func editConfig(edit func(c *Config) error) (err error) {
+	file, err := readConfigFile(configPath)
+	if err != nil {
+		return
+	}
+
+	c := &file.Config
+	if configProfile != "" {
+		c = &Config{}
+		if raw, ok := file.Profiles[configProfile]; ok {
+			if err = json.Unmarshal(raw, c); err != nil {
+				return
+			}
+		}
+	}
+	if err = edit(c); err != nil {
+		return
+	}
+	if configProfile != "" {
+		if file.Profiles == nil {
+			file.Profiles = map[string]json.RawMessage{}
+		}
+		if file.Profiles[configProfile], err = json.Marshal(c); err != nil {
+			return
+		}
+	}
+
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return
+	}
+
+	//the config can hold passwords
+	tmp := configPath + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, configPath)
+}
+
+// checkConfigFile lists the keys in the config file and its profiles that
+// are not settings, which would otherwise be ignored.
+func checkConfigFile(path string) (problems []string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var check func(where string, data []byte, top bool)
+	check = func(where string, data []byte, top bool) {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", where, err))
+			return
+		}
+		for key, raw := range m {
+			var v interface{}
+			switch {
+			case strings.EqualFold(key, "Backend"):
+				continue
+			case top && strings.EqualFold(key, "Profile"):
+				continue
+			case top && strings.EqualFold(key, "Profiles"):
+				var profiles map[string]json.RawMessage
+				json.Unmarshal(raw, &profiles)
+				for name, raw := range profiles {
+					check("profile "+name, raw, false)
+				}
+				continue
+			case strings.EqualFold(key, "Offline"):
+				v = &OfflineConfig{}
+			case strings.EqualFold(key, "Timer"):
+				v = &TimerConfig{}
+			case strings.EqualFold(key, "Daemon"):
+				v = &DaemonConfig{}
+			default:
+				_, t := sectionType(key)
+				if t == nil {
+					problems = append(problems, fmt.Sprintf("%s: no backend has a section named %q", where, key))
+					continue
+				}
+				v = t.config()
+			}
+
+			d := json.NewDecoder(bytes.NewReader(raw))
+			d.DisallowUnknownFields()
+			if err := d.Decode(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s: %s", where, key, err))
+			}
+		}
+	}
+	check(path, data, true)
+	sort.Strings(problems)
+	return
+}
+
+// validateConfig lists the problems with the settings of the backend and
+// each section present.
+func validateConfig(c *Config) (problems []string) {
+	t, ok := backendTypes[c.Backend]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("Backend %q is not one of %s", c.Backend, strings.Join(backendNames(), ", ")))
+	}
+
+	sections := map[string]interface{}{}
+	for key, section := range c.Sections {
+		sections[key] = section
+	}
+	//the backend in use is checked with its defaults if it has no section
+	if ok {
+		if _, found := sections[t.section]; !found {
+			sections[t.section] = t.config()
+		}
+	}
+
+	if c.Timer != nil {
+		sections["Timer"] = c.Timer
+	}
+	if c.Daemon != nil {
+		sections["Daemon"] = c.Daemon
+	}
+
+	keys := make([]string, 0, len(sections))
+	for key := range sections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if val, ok := sections[key].(interface{ validate() []string }); ok {
+			for _, p := range val.validate() {
+				problems = append(problems, key+": "+p)
+			}
+		}
+	}
+	return
+}
+
+// tryBackend opens the backend and asks it for the timer to see that it
+// works.
+func tryBackend(ctx context.Context, c *Config) (err error) {
+	b, err := openBackend(c)
+	if err != nil {
+		return
+	}
+	if m, ok := b.(migrator); ok {
+		if err = checkSchema(ctx, m); err != nil {
+			return
+		}
+	} else if m, ok := asMirror(b); ok {
+		if err = m.checkSchemas(ctx); err != nil {
+			return
+		}
+	}
+	_, err = b.Status(ctx)
+	return
+}
+
 func init() {
 	cmd := &command{
-		short: "prints out the configuration",
-		long:  "doofogy",
-		usage: "config",
+		short: "prints out, changes or checks the configuration",
+		long:  "Prints the configuration with secrets hidden, or with -sources each setting and where it came from: the file, the profile in use or the environment. get and set read and change one setting by its key, like MongoConfig.Host, writing to the profile in use if there is one. init asks for the settings of a backend and writes a new file. validate checks the file for unknown keys and bad values, then tries the backend.",
+		usage: "config [-sources] | get <key> | set <key> <value> | init | validate",
 
 		needsBackend: false,
+		loadsConfig:  true,
 
 		flags: flag.NewFlagSet("config", flag.ExitOnError),
 		run:   config,
+
+		complete: func(args []string, prefix string) (words []string) {
+			switch {
+			case len(args) == 0:
+				return []string{"get", "set", "init", "validate"}
+			case len(args) == 1 && (args[0] == "get" || args[0] == "set"):
+				for _, s := range settings() {
+					words = append(words, s.key)
+				}
+			}
+			return
+		},
 	}
 
+	cmd.flags.BoolVar(&configParams.sources, "sources", false, "list each setting with where it came from")
+
 	commands["config"] = cmd
 }
 
+var configParams struct {
+	sources bool
+}
+
 func config(c *command) {
 	args := c.flags.Args()
-	if len(args) != 0 {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+
+	switch args[0] {
+	case "":
+		if configErr != nil {
+			c.Error(configErr)
+		}
+		if configParams.sources {
+			printSources()
+			return
+		}
+		b, _ := json.MarshalIndent(redact(defaultConfig), "", "\t")
+		os.Stdout.Write(b)
+		os.Stdout.Write([]byte{'\n'})
+
+	case "get":
+		if len(args) != 2 {
+			c.Usage(1)
+		}
+		if configErr != nil {
+			c.Error(configErr)
+		}
+		s, ok := findSetting(args[1])
+		if !ok {
+			c.Error(errorf(ErrInvalidArgument, "unknown setting %q. run 'est config -sources' to see the settings in use", args[1]))
+		}
+		if !s.isSet(defaultConfig) {
+			os.Exit(1)
+		}
+		fmt.Println(s.get(defaultConfig))
+
+	case "set":
+		if len(args) != 3 {
+			c.Usage(1)
+		}
+		s, ok := findSetting(args[1])
+		if !ok {
+			c.Error(errorf(ErrInvalidArgument, "unknown setting %q", args[1]))
+		}
+		err := editConfig(func(conf *Config) error {
+			return s.set(conf, args[2])
+		})
+		if err != nil {
+			c.Error(err)
+		}
+
+	case "init":
+		if len(args) != 1 {
+			c.Usage(1)
+		}
+		configWizard(c)
+
+	case "validate":
+		if len(args) != 1 {
+			c.Usage(1)
+		}
+		problems := checkConfigFile(configPath)
+		if configErr != nil {
+			problems = append(problems, configErr.Error())
+		}
+		problems = append(problems, validateConfig(defaultConfig)...)
+		for _, p := range problems {
+			fmt.Println("problem:", p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+
+		fmt.Printf("connecting to the %s backend... ", defaultConfig.Backend)
+		if err := tryBackend(c.ctx, defaultConfig); err != nil {
+			fmt.Println("failed")
+			c.Error(err)
+		}
+		fmt.Println("ok")
+
+	default:
 		c.Usage(1)
 	}
-	b, _ := json.MarshalIndent(defaultConfig, "", "\t")
-	os.Stdout.Write(b)
-	os.Stdout.Write([]byte{'\n'})
+}
+
+func printSources() {
+	fmt.Println("# file:", configPath)
+	if configProfile != "" {
+		fmt.Println("# profile:", configProfile)
+	}
+	for _, s := range settings() {
+		if source, ok := configSources[s.key]; ok {
+			fmt.Printf("%s = %s\t# %s\n", s.key, s.get(defaultConfig), source)
+		}
+	}
+}
+
+// configWizard asks for a backend and its settings, tries connecting with
+// them and saves them to the config file.
+func configWizard(c *command) {
+	in := bufio.NewReader(os.Stdin)
+	ask := func(question, def string) string {
+		fmt.Printf("%s [%s]: ", question, def)
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			os.Exit(1)
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			return def
+		}
+		return line
+	}
+	yes := func(question string) bool {
+		answer := strings.ToLower(ask(question+" (y/n)", "n"))
+		return answer == "y" || answer == "yes"
+	}
+
+	if _, err := os.Stat(configPath); err == nil && configProfile == "" {
+		if !yes(fmt.Sprintf("%s exists. replace it", configPath)) {
+			return
+		}
+	}
+
+	conf := &Config{}
+	fmt.Println("backends:", strings.Join(backendNames(), ", "))
+	for {
+		conf.Backend = ask("backend", "mongo")
+		if _, ok := backendTypes[conf.Backend]; ok {
+			break
+		}
+		fmt.Println("unknown backend", conf.Backend)
+	}
+
+	//start from the built in settings for mongo
+	t := backendTypes[conf.Backend]
+	conf.Sections = map[string]interface{}{t.section: t.config()}
+	if conf.Backend == "mongo" {
+		conf.Sections[t.section] = &MongoConfig{Host: "localhost", Database: "est"}
+	}
+
+	section := t.section + "."
+	for _, s := range settings() {
+		if !strings.HasPrefix(s.key, section) {
+			continue
+		}
+		for {
+			err := s.set(conf, ask(strings.TrimPrefix(s.key, section), s.get(conf)))
+			if err == nil {
+				break
+			}
+			fmt.Println(err)
+		}
+	}
+
+	problems := validateConfig(conf)
+	for _, p := range problems {
+		fmt.Println("problem:", p)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("connecting to the %s backend... ", conf.Backend)
+		if err := tryBackend(c.ctx, conf); err != nil {
+			fmt.Println(err)
+			problems = append(problems, err.Error())
+		} else {
+			fmt.Println("ok")
+		}
+	}
+	if len(problems) > 0 && !yes("save anyway") {
+		os.Exit(1)
+	}
+
+	err := editConfig(func(c *Config) error {
+		*c = *conf
+		return nil
+	})
+	if err != nil {
+		c.Error(err)
+	}
+	fmt.Println("saved to", configPath)
 }
@@ -30,7 +30,7 @@ func create(c *command) {
 	if err != nil {
 		c.Error(err)
 	}
-	if err := stopIfStarted(); err != nil {
+	if err := stopIfStarted(c.ctx); err != nil {
 		c.Error(err)
 	}
 	task := &Task{
@@ -38,10 +38,10 @@ func create(c *command) {
 		Annotations: []Annotation{{When: time.Now(), EstimateDelta: dur}},
 		Estimate:    dur,
 	}
-	if err := defaultBackend.Save(task); err != nil {
+	if err := defaultBackend.Save(c.ctx, task); err != nil {
 		c.Error(err)
 	}
-	if err := defaultBackend.Start(task.Name); err != nil {
+	if err := defaultBackend.Start(c.ctx, task.Name); err != nil {
 		c.Error(err)
 	}
 	fmt.Println("started working on", task.Name)
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func init() {
+	cmd := &command{
+		short: "watches the timer and sends reminders",
+		long:  "Keeps running, checking the timer every Interval of the Daemon config, and sends a reminder when the running task's time crosses each of the Thresholds as a percent of its estimate, when the timer is still running after WorkEnd, and when no timer has run for IdleReminder between WorkStart and WorkEnd on a weekday. Reminders go through the Notifier: desktop uses notify-send or osascript, terminal prints them, command runs Command with EST_TITLE and EST_MESSAGE set, and webhook posts them as json to Webhook. Stop it with an interrupt.",
+		usage: "daemon [-interval=] [-notifier=]",
+
+		needsBackend: true,
+
+		flags: flag.NewFlagSet("daemon", flag.ExitOnError),
+		run:   daemon,
+	}
+
+	cmd.flags.DurationVar(&daemonParams.interval, "interval", 0, "how often to check the timer, overriding the config")
+	cmd.flags.StringVar(&daemonParams.notifier, "notifier", "", "how to send reminders, overriding the config: "+strings.Join(notifierNames(), ", "))
+
+	commands["daemon"] = cmd
+}
+
+var daemonParams struct {
+	interval time.Duration
+	notifier string
+}
+
+// DaemonConfig says when est daemon sends reminders and how.
+type DaemonConfig struct {
+	Interval     Duration `json:",omitempty"` //how often to check the timer. default 1m
+	Notifier     string   `json:",omitempty"` //desktop, terminal, command or webhook. default desktop if there's a display, else terminal
+	Command      string   `json:",omitempty"` //run by the command notifier with EST_TITLE and EST_MESSAGE set
+	Webhook      *Secret  `json:",omitempty"` //url the webhook notifier posts to
+	Thresholds   []int    `json:",omitempty"` //percents of the estimate to remind at. default 50, 100 and 150
+	WorkStart    string   `json:",omitempty"` //start of the working day on weekdays. default 09:00
+	WorkEnd      string   `json:",omitempty"` //timers running past this are reported. default 18:00
+	IdleReminder Duration `json:",omitempty"` //how long without a timer in working hours before a reminder. default 30m
+}
+
+const (
+	defaultDaemonInterval = time.Minute
+	defaultIdleReminder   = 30 * time.Minute
+)
+
+func (c *DaemonConfig) validate() (problems []string) {
+	if _, ok := notifierTypes[c.Notifier]; !ok && c.Notifier != "" {
+		problems = append(problems, fmt.Sprintf("Notifier %q is not one of %s", c.Notifier, strings.Join(notifierNames(), ", ")))
+	}
+	switch {
+	case c.Notifier == "command" && c.Command == "":
+		problems = append(problems, "the command notifier needs a Command")
+	case c.Notifier == "webhook" && !c.Webhook.isSet():
+		problems = append(problems, "the webhook notifier needs a Webhook")
+	}
+	for _, t := range c.Thresholds {
+		if t <= 0 {
+			problems = append(problems, fmt.Sprintf("threshold %d%% isn't above zero", t))
+		}
+	}
+	for _, clock := range []string{c.WorkStart, c.WorkEnd} {
+		if _, err := time.Parse("15:04", clock); err != nil && clock != "" {
+			problems = append(problems, fmt.Sprintf("%q is not a time like 09:00", clock))
+		}
+	}
+	if c.Interval < 0 || c.IdleReminder < 0 {
+		problems = append(problems, "Interval and IdleReminder can't be negative")
+	}
+	return
+}
+
+func daemonConfig() *DaemonConfig {
+	c := DaemonConfig{}
+	if defaultConfig.Daemon != nil {
+		c = *defaultConfig.Daemon
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultDaemonInterval)
+	}
+	if c.Notifier == "" {
+		c.Notifier = "terminal"
+		if os.Getenv("DISPLAY") != "" || runtime.GOOS == "darwin" {
+			c.Notifier = "desktop"
+		}
+	}
+	if c.Thresholds == nil {
+		c.Thresholds = []int{50, 100, 150}
+	}
+	if c.WorkStart == "" {
+		c.WorkStart = "09:00"
+	}
+	if c.WorkEnd == "" {
+		c.WorkEnd = "18:00"
+	}
+	if c.IdleReminder == 0 {
+		c.IdleReminder = Duration(defaultIdleReminder)
+	}
+	return &c
+}
+
+//
+// notifiers
+//
+
+// notifier shows a reminder to the user.
+type notifier interface {
+	notify(title, message string) error
+}
+
+// notifierTypes makes each kind of notifier from the config.
+var notifierTypes = map[string]func(c *DaemonConfig) (notifier, error){
+	"terminal": func(c *DaemonConfig) (notifier, error) { return terminalNotifier{}, nil },
+	"desktop":  func(c *DaemonConfig) (notifier, error) { return desktopNotifier{}, nil },
+	"command": func(c *DaemonConfig) (notifier, error) {
+		if c.Command == "" {
+			return nil, errorf(ErrInvalidArgument, "the command notifier needs a Command")
+		}
+		return commandNotifier(c.Command), nil
+	},
+	"webhook": func(c *DaemonConfig) (notifier, error) {
+		url, err := c.Webhook.reveal()
+		if err == nil && url == "" {
+			err = errorf(ErrInvalidArgument, "the webhook notifier needs a Webhook")
+		}
+		return webhookNotifier(url), err
+	},
+}
+
+func notifierNames() (names []string) {
+	for name := range notifierTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// terminalNotifier prints the reminder and rings the bell.
+type terminalNotifier struct{}
+
+func (terminalNotifier) notify(title, message string) error {
+	_, err := fmt.Printf("\a%s %s: %s\n", time.Now().Format("15:04"), title, message)
+	return err
+}
+
+// desktopNotifier pops up a notification with notify-send, or osascript on
+// macs.
+type desktopNotifier struct{}
+
+func (desktopNotifier) notify(title, message string) error {
+	cmd := exec.Command("notify-send", "--app-name=est", title, message)
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", message, title))
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s %s", cmd.Args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// commandNotifier runs a command through the shell.
+type commandNotifier string
+
+func (c commandNotifier) notify(title, message string) error {
+	cmd := exec.Command("sh", "-c", string(c))
+	cmd.Env = append(os.Environ(), "EST_TITLE="+title, "EST_MESSAGE="+message)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// webhookNotifier posts the reminder as json to a url.
+type webhookNotifier string
+
+const webhookTimeout = 10 * time.Second
+
+func (url webhookNotifier) notify(title, message string) error {
+	body, _ := json.Marshal(map[string]string{"title": title, "message": message, "text": title + ": " + message})
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(string(url), "application/json", bytes.NewReader(body))
+	if err != nil {
+		//the url may hold a token, so leave it out
+		if uerr, ok := err.(interface{ Unwrap() error }); ok {
+			err = uerr.Unwrap()
+		}
+		return fmt.Errorf("webhook: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+//
+// daemon
+//
+
+func daemon(c *command) {
+	args := c.flags.Args()
+	if len(args) != 0 {
+		c.Usage(1)
+	}
+
+	conf := daemonConfig()
+	if daemonParams.interval > 0 {
+		conf.Interval = Duration(daemonParams.interval)
+	}
+	if daemonParams.notifier != "" {
+		conf.Notifier = daemonParams.notifier
+	}
+	if problems := conf.validate(); len(problems) > 0 {
+		c.Error(errorf(ErrInvalidArgument, "daemon config: %s", strings.Join(problems, "; ")))
+	}
+	n, err := notifierTypes[conf.Notifier](conf)
+	if err != nil {
+		c.Error(err)
+	}
+
+	w := &watcher{
+		conf:     conf,
+		notifier: n,
+		crossed:  map[string]int{},
+		running:  time.Now(),
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	tick := time.NewTicker(time.Duration(conf.Interval))
+	defer tick.Stop()
+
+	fmt.Fprintf(os.Stderr, "watching the timer every %s, reminding with %s\n", time.Duration(conf.Interval), conf.Notifier)
+	for {
+		if err := w.check(c.ctx, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error: %s\n", time.Now().Format("15:04:05"), err)
+		}
+		select {
+		case <-tick.C:
+		case <-sigs:
+			return
+		}
+	}
+}
+
+// watcher remembers which reminders it sent, so each is sent once.
+type watcher struct {
+	conf     *DaemonConfig
+	notifier notifier
+
+	crossed  map[string]int //highest threshold reminded, keyed by task and estimate
+	late     time.Time      //start of the session reminded for running past the end of the day
+	running  time.Time      //last time a timer was seen running
+	reminded time.Time      //last reminder that no timer was running
+}
+
+// check looks at the timer and sends the reminders that are due.
+func (w *watcher) check(ctx context.Context, now time.Time) (err error) {
+	log, err := defaultBackend.Status(ctx)
+	if err != nil {
+		return
+	}
+	if log == nil {
+		return w.checkIdle(now)
+	}
+	w.running = now
+
+	task, err := defaultBackend.Load(ctx, log.Name)
+	if err != nil {
+		return
+	}
+	actual := task.Actual + now.Sub(log.When)
+
+	if task.Estimate > 0 {
+		key := fmt.Sprintf("%s %s", task.Name, task.Estimate)
+		percent := int(100 * actual / task.Estimate)
+		highest := 0
+		for _, t := range w.conf.Thresholds {
+			if percent >= t && t > highest {
+				highest = t
+			}
+		}
+		if highest > w.crossed[key] {
+			w.crossed[key] = highest
+			err = w.notifier.notify(task.Name, fmt.Sprintf("%d%% of the estimate spent, %s of %s", highest, roughly(actual), task.Estimate))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	end := clockOn(log.When, w.conf.WorkEnd)
+	if log.When.After(end) {
+		end = log.When
+	}
+	if now.After(end) && !w.late.Equal(log.When) {
+		w.late = log.When
+		err = w.notifier.notify(task.Name, fmt.Sprintf("the timer is running past the end of the day, for %s now", roughly(now.Sub(log.When))))
+	}
+	return
+}
+
+// checkIdle reminds to start a timer when none has run for a while during
+// working hours on a weekday.
+func (w *watcher) checkIdle(now time.Time) error {
+	start, end := clockOn(now, w.conf.WorkStart), clockOn(now, w.conf.WorkEnd)
+	if now.Weekday() == time.Saturday || now.Weekday() == time.Sunday || now.Before(start) || !now.Before(end) {
+		return nil
+	}
+
+	since := w.running
+	if since.Before(start) {
+		since = start
+	}
+	every := time.Duration(w.conf.IdleReminder)
+	if now.Sub(since) < every || now.Sub(w.reminded) < every {
+		return nil
+	}
+	w.reminded = now
+	return w.notifier.notify("est", fmt.Sprintf("no timer running for %s", roughly(now.Sub(since))))
+}
+
+// clockOn is the time of day given like 18:00 on the day of t.
+func clockOn(t time.Time, clock string) time.Time {
+	c, _ := time.Parse("15:04", clock)
+	return time.Date(t.Year(), t.Month(), t.Day(), c.Hour(), c.Minute(), 0, 0, t.Location())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func init() {
+	cmd := &command{
+		short: "shows or upgrades the schema of the stored data",
+		long:  "version prints the schema version of the stored data and the version this est uses. upgrade runs the migrations the stored data is missing, which est asks for when it finds data older than it uses. Back up the data before upgrading.",
+		usage: "db <version | upgrade>",
+
+		//the backend is opened without the schema check
+		needsBackend: false,
+
+		flags: flag.NewFlagSet("db", flag.ExitOnError),
+		run:   db,
+
+		complete: wordArgs("version", "upgrade"),
+	}
+
+	commands["db"] = cmd
+}
+
+func db(c *command) {
+	args := c.flags.Args()
+	if len(args) != 1 {
+		c.Usage(1)
+	}
+
+	b, err := openBackend(defaultConfig)
+	if err != nil {
+		c.Error(err)
+	}
+	m, ok := b.(migrator)
+	if !ok {
+		c.Error(errorf(ErrInvalidArgument, "the %s backend has no schema of its own. run est db where the data is stored", defaultConfig.Backend))
+	}
+
+	switch args[0] {
+	case "version":
+		v, err := m.schema(c.ctx)
+		if err != nil {
+			c.Error(err)
+		}
+		fmt.Println("stored schema version:", v)
+		fmt.Println("est schema version:", currentSchema())
+
+	case "upgrade":
+		err := upgradeSchema(c.ctx, m, func(mig migration) {
+			fmt.Printf("migrating to version %d: %s\n", mig.version, mig.desc)
+		})
+		if err != nil {
+			c.Error(err)
+		}
+		fmt.Println("schema is at version", currentSchema())
+
+	default:
+		c.Usage(1)
+	}
+}
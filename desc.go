@@ -19,6 +19,8 @@ func init() {
 
 		flags: flag.NewFlagSet("desc", flag.ExitOnError),
 		run:   desc,
+
+		complete: taskArgs(1),
 	}
 
 	commands["desc"] = cmd
@@ -29,7 +31,7 @@ func desc(c *command) {
 	if len(args) < 1 {
 		c.Usage(1)
 	}
-	task, err := defaultBackend.Load(args[0])
+	task, err := loadTask(c.ctx, args[0])
 	if err != nil {
 		c.Error(err)
 	}
@@ -45,7 +47,7 @@ func desc(c *command) {
 		desc = strings.TrimSpace(buf.String())
 	}
 
-	if err := defaultBackend.SetDescription(task, desc); err != nil {
+	if err := defaultBackend.SetDescription(c.ctx, task, desc); err != nil {
 		c.Error(err)
 	}
 
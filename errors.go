@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// ErrorCode classifies the errors returned by backends so callers can react
+// to them without matching on text.
+type ErrorCode string
+
+const (
+	ErrNotFound        ErrorCode = "not-found"
+	ErrConflict        ErrorCode = "conflict"
+	ErrInvalidArgument ErrorCode = "invalid-argument"
+	ErrUnavailable     ErrorCode = "unavailable"
+	ErrUnauthorized    ErrorCode = "unauthorized"
+)
+
+// Error is an error with a code. errors without a code are internal.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(code ErrorCode, format string, args ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// errorCode returns the code of the error, or the empty string if it has
+// none.
+func errorCode(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// isCode reports if the error has the given code.
+func isCode(err error, code ErrorCode) bool {
+	return err != nil && errorCode(err) == code
+}
+
+//
+// carrying codes across the rpc boundary. net/rpc only sends the text of an
+// error, so the code is sent as a prefix on it.
+//
+
+var codedError = regexp.MustCompile(`^\[([a-z-]+)\] (?s:(.*))$`)
+
+// encodeError prefixes the error with its code so rpcClient can rebuild it.
+func encodeError(e *error) {
+	if *e == nil {
+		return
+	}
+	if code := errorCode(*e); code != "" {
+		*e = fmt.Errorf("[%s] %s", code, *e)
+	}
+}
+
+// decodeError rebuilds an error encoded by encodeError. errors that came from
+// the connection rather than the server mean the server is unavailable.
+func decodeError(e *error, serverError bool) {
+	if *e == nil {
+		return
+	}
+	if !serverError {
+		if errorCode(*e) == "" {
+			*e = errorf(ErrUnavailable, "%s", *e)
+		}
+		return
+	}
+	if m := codedError.FindStringSubmatch((*e).Error()); m != nil {
+		*e = errorf(ErrorCode(m[1]), "%s", m[2])
+		return
+	}
+	*e = errors.New((*e).Error())
+}
+
+//
+// presenting errors
+//
+
+// errorStatus is the http status for the error in the rest api.
+func errorStatus(err error) int {
+	switch errorCode(err) {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrConflict:
+		return http.StatusConflict
+	case ErrInvalidArgument:
+		return http.StatusBadRequest
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// errorExit is the exit status for a command that failed with the error.
+func errorExit(err error) int {
+	switch errorCode(err) {
+	case ErrNotFound:
+		return 3
+	case ErrConflict:
+		return 4
+	case ErrInvalidArgument:
+		return 5
+	case ErrUnavailable:
+		return 6
+	case ErrUnauthorized:
+		return 7
+	}
+	return 1
+}
+
+// errorHint is a suggestion printed after the error for the user.
+func errorHint(err error) string {
+	switch errorCode(err) {
+	case ErrNotFound:
+		return "run 'est log' to see your tasks"
+	case ErrConflict:
+		return "someone else changed it first. try again"
+	case ErrUnavailable:
+		return "check that the backend is running and reachable"
+	case ErrUnauthorized:
+		return "check the Token in the RPCConfig section of your config"
+	}
+	return ""
+}
@@ -1,44 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"sort"
 )
 
 var configPath string
 
 func main() {
-	defaultPath := os.ExpandEnv("$HOME/.est")
+	defaultPath := defaultConfigPath()
 	flag.StringVar(&configPath, "config", defaultPath, "path to configuration file")
+	flag.StringVar(&configProfile, "profile", os.Getenv("EST_PROFILE"), "profile in the configuration file to use")
 	flag.Parse()
 
-	//load the configuration if we can
-	f, err := os.Open(configPath)
-	if err != nil {
-		//we had an error opening it. check if the path is the default path
-		//in which case just silently use the default config
-		if configPath == defaultPath {
-			goto configLoaded
-		}
-
-		//print that we had an error opening it and use the default config
-		fmt.Fprintf(os.Stderr, "%s.\nusing default configuration.\n\n", err)
-		goto configLoaded
-	}
-
-	//attempt to load the configuration
-	defaultConfig = &Config{}
-	err = json.NewDecoder(f).Decode(defaultConfig)
-	f.Close()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing config file: %s\n", err)
-		os.Exit(1)
-	}
-
-configLoaded:
 	//grab the command out
 	args := flag.Args()
 	if len(args) == 0 {
@@ -51,30 +27,33 @@ configLoaded:
 		UnknownCommand(cmdname)
 	}
 
+	configErr = loadConfig(configPath, configPath == defaultPath)
+	if configErr != nil && !cmd.loadsConfig {
+		fmt.Fprintln(os.Stderr, configErr)
+		os.Exit(errorExit(configErr))
+	}
+
 	//connect to the backend only if the command needs it
 	if cmd.needsBackend {
 		if err := loadBackend(defaultConfig); err != nil {
 			fmt.Fprintf(os.Stderr, "unable to connect to backend: %s\n", err)
-			os.Exit(1)
+			os.Exit(errorExit(err))
 		}
 	}
 
+	cmd.ctx = context.Background()
 	cmd.flags.Parse(args[1:])
 	cmd.run(cmd)
 }
 
 func Usage(status int) {
 	fmt.Fprintln(os.Stderr, "est is a tool for managing estimates\n")
-	fmt.Fprintln(os.Stderr, "usage: est [-config=] command [args]")
+	fmt.Fprintln(os.Stderr, "usage: est [-config=] [-profile=] command [args]")
 	flag.PrintDefaults()
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "The commands are:\n")
 
-	names := make([]string, 0, len(commands))
-	for k := range commands {
-		names = append(names, k)
-	}
-	sort.Strings(names)
+	names := commandNames()
 	for _, cmdname := range names {
 		cmd := commands[cmdname]
 		fmt.Fprintf(os.Stderr, "\test % -10s %s\n", cmdname, cmd.short)
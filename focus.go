@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+func init() {
+	cmd := &command{
+		short: "works on a task in timed focus sessions with breaks between",
+		long:  "Starts the timer on the task and counts down the length of a session. When the session ends the timer stops and the session is recorded on the task, then the break is counted down before the next session. Interrupting a session stops the timer and records the time spent, but not as a session. log shows the number of sessions on each task.",
+		usage: "focus [-length=25m] [-break=5m] [-count=1] <task name>",
+
+		needsBackend: true,
+
+		flags: flag.NewFlagSet("focus", flag.ExitOnError),
+		run:   focus,
+
+		complete: taskArgs(1),
+	}
+
+	cmd.flags.DurationVar(&focusParams.length, "length", 25*time.Minute, "how long each session lasts")
+	cmd.flags.DurationVar(&focusParams.breakLength, "break", 5*time.Minute, "how long the break after each session lasts")
+	cmd.flags.IntVar(&focusParams.count, "count", 1, "how many sessions to run. 0 runs them until interrupted")
+
+	commands["focus"] = cmd
+}
+
+var focusParams struct {
+	length      time.Duration
+	breakLength time.Duration
+	count       int
+}
+
+func focus(c *command) {
+	args := c.flags.Args()
+	if len(args) != 1 {
+		c.Usage(1)
+	}
+	if focusParams.length <= 0 || focusParams.breakLength < 0 || focusParams.count < 0 {
+		c.Error(errorf(ErrInvalidArgument, "the length must be above zero, and the break and count can't be negative"))
+	}
+
+	task, err := loadTask(c.ctx, args[0])
+	if err != nil {
+		c.Error(err)
+	}
+
+	//an interrupted session records the time spent, just not as a session
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	for n := 1; focusParams.count == 0 || n <= focusParams.count; n++ {
+		if err := stopIfStarted(c.ctx); err != nil {
+			c.Error(err)
+		}
+		if err := defaultBackend.Start(c.ctx, task.Name); err != nil {
+			c.Error(err)
+		}
+		log, err := defaultBackend.Status(c.ctx)
+		if err != nil {
+			c.Error(err)
+		}
+		if log == nil {
+			c.Error(errorf(ErrConflict, "the timer was stopped as soon as it started"))
+		}
+
+		fmt.Printf("focusing on %s for %s\n", task.Name, focusParams.length)
+		if !countdown(fmt.Sprintf("%s #%d", task.Name, n), log.When, focusParams.length, sigs) {
+			if err := stopFocus(c.ctx, log); err != nil {
+				c.Error(err)
+			}
+			return
+		}
+
+		if task, err = endFocus(c.ctx, log, focusParams.length); err != nil {
+			c.Error(err)
+		}
+		fmt.Printf("\asession done. %s\n", task)
+
+		if focusParams.breakLength > 0 {
+			fmt.Printf("take a break for %s\n", focusParams.breakLength)
+			if !countdown("break", time.Now(), focusParams.breakLength, sigs) {
+				return
+			}
+			fmt.Println("\abreak over")
+		}
+	}
+}
+
+// countdown shows the time left until start+length on a terminal, and tells
+// if it ran out without being interrupted.
+func countdown(label string, start time.Time, length time.Duration, sigs <-chan os.Signal) bool {
+	show := term.IsTerminal(int(os.Stdout.Fd()))
+	end := start.Add(length)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	if show {
+		defer fmt.Print("\r\033[K")
+	}
+
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			return true
+		}
+		if show {
+			left := end.Sub(now).Round(time.Second)
+			fmt.Printf("\r%s %s %s left\033[K", label, uiBar(now.Sub(start), length, 20), left)
+		}
+
+		select {
+		case <-tick.C:
+		case <-sigs:
+			return false
+		}
+	}
+}
+
+// endFocus stops the timer of a finished session at the end of its length,
+// even if the countdown ran late, and marks the time as a focus session.
+func endFocus(ctx context.Context, log *StartLog, length time.Duration) (task *Task, err error) {
+	if err = sameTimer(ctx, log); err != nil {
+		return
+	}
+	//the timer stops and the time is recorded in one operation, so only
+	//marking it as a session can fail afterwards
+	stopped, task, err := stopSameTimer(ctx, log, log.When.Add(length))
+	if err != nil {
+		return
+	}
+
+	//replace the annotation the timer added with the same one marked as a
+	//session. the revision makes sure nothing was added after it.
+	ann := task.Annotations[len(task.Annotations)-1]
+	ann.Focus = true
+	if err = defaultBackend.PopAnnotation(ctx, task); err != nil {
+		err = fmt.Errorf("the time was recorded but not as a session: %s", err)
+		return
+	}
+	if err = defaultBackend.AddAnnotation(ctx, task, ann); err != nil {
+		err = fmt.Errorf("the timer stopped but the session wasn't recorded: %s. use 'est add %s %s' to record it", err, stopped.Name, length)
+		return
+	}
+	task.Annotations[len(task.Annotations)-1] = ann
+	return
+}
+
+// stopFocus stops the timer of an interrupted session.
+func stopFocus(ctx context.Context, log *StartLog) (err error) {
+	if err = sameTimer(ctx, log); err != nil {
+		return
+	}
+	_, task, err := stopSameTimer(ctx, log, time.Now())
+	if err != nil {
+		return
+	}
+	ann := task.Annotations[len(task.Annotations)-1]
+	fmt.Println("session interrupted. adding", ann.ActualDelta.Round(time.Second), "to", log.Name)
+	return
+}
+
+// stopSameTimer stops the timer, and reports if it was stopped or replaced
+// elsewhere since sameTimer checked it.
+func stopSameTimer(ctx context.Context, log *StartLog, when time.Time) (stopped *StartLog, task *Task, err error) {
+	stopped, task, err = defaultBackend.StopTimer(ctx, when)
+	switch {
+	case err != nil:
+	case stopped == nil:
+		err = errorf(ErrConflict, "the timer on %s was stopped during the session", log.Name)
+	case stopped.Name != log.Name || !stopped.When.Equal(log.When):
+		err = errorf(ErrConflict, "the timer was changed during the session. stopped the timer on %s instead", stopped.Name)
+	}
+	return
+}
+
+// sameTimer makes sure the timer running is still the one the session
+// started, and not one started or stopped elsewhere meanwhile.
+func sameTimer(ctx context.Context, log *StartLog) (err error) {
+	now, err := defaultBackend.Status(ctx)
+	if err == nil && (now == nil || now.Name != log.Name || !now.When.Equal(log.When)) {
+		err = errorf(ErrConflict, "the timer on %s was stopped or changed during the session", log.Name)
+	}
+	return
+}
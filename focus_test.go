@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testFocusTimer(t *testing.T) *StartLog {
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(t.TempDir(), "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultBackend = b
+	ctx := context.Background()
+	testSave(t, b, "deep")
+	if err := b.Start(ctx, "deep"); err != nil {
+		t.Fatal(err)
+	}
+	log, err := b.Status(ctx)
+	if err != nil || log == nil {
+		t.Fatal(log, err)
+	}
+	return log
+}
+
+func TestEndFocus(t *testing.T) {
+	log := testFocusTimer(t)
+	ctx := context.Background()
+
+	task, err := endFocus(ctx, log, 25*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := defaultBackend.Load(ctx, "deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []*Task{task, stored} {
+		if task.Sessions() != 1 || task.Actual != 25*time.Minute {
+			t.Errorf("%s has %d sessions", task, task.Sessions())
+		}
+	}
+	if now, _ := defaultBackend.Status(ctx); now != nil {
+		t.Errorf("the timer is still running: %v", now)
+	}
+}
+
+func TestStopFocusStoppedElsewhere(t *testing.T) {
+	log := testFocusTimer(t)
+	ctx := context.Background()
+
+	if err := defaultBackend.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := stopFocus(ctx, log); !isCode(err, ErrConflict) {
+		t.Fatalf("stopping a timer stopped elsewhere: %v", err)
+	}
+	//stopped after the check
+	if _, _, err := stopSameTimer(ctx, log, time.Now()); !isCode(err, ErrConflict) {
+		t.Fatalf("stopping a timer stopped since the check: %v", err)
+	}
+}
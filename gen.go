@@ -99,7 +99,7 @@ func gen(c *command) {
 	}
 
 	//grab the tasks in the history range
-	tasks, err := defaultBackend.Find("", low, high)
+	tasks, err := defaultBackend.Find(c.ctx, "", low, high)
 	if err != nil {
 		c.Error(err)
 	}
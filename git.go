@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitConfig is for a backend keeping each task as a json file in a git
+// repository, committing every change.
+type GitConfig struct {
+	Dir    string `json:",omitempty"` //the repository. default $HOME/.est-tasks
+	Remote string `json:",omitempty"` //remote to pull from when opened and push to after every change
+}
+
+func init() {
+	backendTypes["git"] = &backendType{
+		section: "GitConfig",
+		config:  func() interface{} { return &GitConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openGit(conf.(*GitConfig)) },
+	}
+}
+
+func openGit(c *GitConfig) (b Backend, err error) {
+	dir := c.Dir
+	if dir == "" {
+		dir = os.ExpandEnv("$HOME/.est-tasks")
+	}
+	g := &gitBackend{dir: dir, remote: c.Remote}
+	ctx := context.Background()
+
+	if _, err = exec.LookPath("git"); err != nil {
+		err = errorf(ErrUnavailable, "the git backend needs git installed: %s", err)
+		return
+	}
+	if _, err = os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return
+		}
+		if _, err = g.git(ctx, "init", "-q"); err != nil {
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	//commit as est when the user has no identity set up for git
+	if _, err := g.git(ctx, "config", "user.email"); err != nil {
+		g.identity = []string{"-c", "user.name=est", "-c", "user.email=est@localhost"}
+	}
+
+	if g.remote != "" {
+		err = g.locked(func() error {
+			g.pull(ctx)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	//est had schema versions before this backend, so new repositories are
+	//current
+	if _, err = os.Stat(g.schemaPath()); os.IsNotExist(err) {
+		err = g.change(ctx, fmt.Sprintf("start at schema version %d", currentSchema()), func() error {
+			return ioutil.WriteFile(g.schemaPath(), []byte(strconv.Itoa(currentSchema())+"\n"), 0600)
+		})
+	}
+	if err != nil {
+		return
+	}
+
+	b = g
+	return
+}
+
+type gitBackend struct {
+	dir      string
+	remote   string
+	identity []string //config for commits when git has no user set up
+	ns       string   //directory of the user's tasks. empty without users
+}
+
+// Namespace returns a backend on a directory of the repository for the user.
+func (g *gitBackend) Namespace(user string) Backend {
+	n := *g
+	n.ns = filepath.Join("users", user)
+	return &n
+}
+
+//
+// running git
+//
+
+func (g *gitBackend) git(ctx context.Context, args ...string) (out []byte, err error) {
+	args = append(append([]string{"-C", g.dir}, g.identity...), args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		err = fmt.Errorf("git %s: %s", args[len(g.identity)+2], msg)
+	}
+	return
+}
+
+// pull brings in changes from the remote. failing to reach it isn't fatal,
+// the changes are picked up next time.
+func (g *gitBackend) pull(ctx context.Context) {
+	_, err := g.git(ctx, "pull", "-q", "--rebase", g.remote, "HEAD")
+	if err != nil && strings.Contains(err.Error(), "couldn't find remote ref") {
+		//nothing has been pushed to the remote yet
+		return
+	}
+	if err != nil {
+		g.git(ctx, "rebase", "--abort")
+		fmt.Fprintf(os.Stderr, "warning: unable to pull from %s: %s\n", g.remote, err)
+	}
+}
+
+// push sends the commits to the remote, pulling first if the remote has
+// moved on.
+func (g *gitBackend) push(ctx context.Context) {
+	if _, err := g.git(ctx, "push", "-q", g.remote, "HEAD"); err == nil {
+		return
+	}
+	g.pull(ctx)
+	if _, err := g.git(ctx, "push", "-q", g.remote, "HEAD"); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: unable to push to %s: %s\n", g.remote, err)
+		fmt.Fprintf(os.Stderr, "the change is committed in %s and will be pushed with the next one\n", g.dir)
+	}
+}
+
+// locked runs fn holding the lock on the repository, so no other est changes
+// the files or commits meanwhile.
+func (g *gitBackend) locked(fn func() error) (err error) {
+	unlock, err := lockFile(filepath.Join(g.dir, ".git", "est.lock"), defaultLockTimeout)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	return fn()
+}
+
+// change runs fn to change the files and commits whatever it changed with
+// the message, holding the lock on the repository.
+func (g *gitBackend) change(ctx context.Context, message string, fn func() error) (err error) {
+	return g.locked(func() error {
+		return g.commit(ctx, message, fn)
+	})
+}
+
+// commit does the work of change for a caller holding the lock. if fn or the
+// commit fails, the files go back to the last commit so the next change
+// doesn't pick up half of this one.
+func (g *gitBackend) commit(ctx context.Context, message string, fn func() error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			g.discard()
+		}
+	}()
+	if err = fn(); err != nil {
+		return
+	}
+	if _, err = g.git(ctx, "add", "-A", "--", "."); err != nil {
+		return
+	}
+
+	//nothing to commit when the change didn't change anything
+	if _, err = g.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		return
+	}
+	if _, err = g.git(ctx, "commit", "-q", "-m", message); err != nil {
+		return
+	}
+	if g.remote != "" {
+		g.push(ctx)
+	}
+	return
+}
+
+// discard throws away changes that weren't committed. it doesn't use the
+// context of the change, which may be why the change failed.
+func (g *gitBackend) discard() {
+	ctx := context.Background()
+	g.git(ctx, "reset", "-q", "--hard", "HEAD")
+	g.git(ctx, "clean", "-q", "-f", "-d")
+}
+
+//
+// files
+//
+
+func (g *gitBackend) schemaPath() string {
+	return filepath.Join(g.dir, "schema")
+}
+
+func (g *gitBackend) tasksDir() string {
+	return filepath.Join(g.dir, g.ns, "tasks")
+}
+
+func (g *gitBackend) timerPath() string {
+	return filepath.Join(g.dir, g.ns, "timer.json")
+}
+
+// taskPath escapes the name so any task name makes one file.
+func (g *gitBackend) taskPath(name string) string {
+	return filepath.Join(g.tasksDir(), url.PathEscape(name)+".json")
+}
+
+func (g *gitBackend) read(name string) (task *Task, err error) {
+	data, err := ioutil.ReadFile(g.taskPath(name))
+	if os.IsNotExist(err) {
+		err = errorf(ErrNotFound, "task %q not found", name)
+	}
+	if err != nil {
+		return
+	}
+	task = new(Task)
+	if err = json.Unmarshal(data, task); err != nil {
+		err = fmt.Errorf("error parsing %s: %s", g.taskPath(name), err)
+	}
+	return
+}
+
+func (g *gitBackend) write(task *Task) (err error) {
+	data, err := json.MarshalIndent(task, "", "\t")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(g.tasksDir(), 0700); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(g.taskPath(task.Name), append(data, '\n'), 0600)
+	return
+}
+
+// readRevision reads the task for a change, failing if it moved past the
+// revision the caller loaded.
+func (g *gitBackend) readRevision(task *Task) (stored *Task, err error) {
+	if stored, err = g.read(task.Name); err != nil {
+		return
+	}
+	if stored.Revision != task.Revision {
+		err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+	}
+	return
+}
+
+func (g *gitBackend) names() (names []string, err error) {
+	files, err := ioutil.ReadDir(g.tasksDir())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	for _, f := range files {
+		base := strings.TrimSuffix(f.Name(), ".json")
+		if base == f.Name() {
+			continue
+		}
+		name, err := url.PathUnescape(base)
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+func (g *gitBackend) readTimer() (log *StartLog, err error) {
+	data, err := ioutil.ReadFile(g.timerPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	log = new(StartLog)
+	err = json.Unmarshal(data, log)
+	return
+}
+
+//
+// Backend
+//
+
+func (g *gitBackend) Save(ctx context.Context, task *Task) (err error) {
+	var candidate string
+	err = g.locked(func() error {
+		//while theres a task with this name, increment the number on the end of it
+		candidate = task.Name
+		for i := 1; ; i++ {
+			if _, err := os.Stat(g.taskPath(candidate)); os.IsNotExist(err) {
+				break
+			}
+			candidate = fmt.Sprintf("%s%d", task.Name, i)
+		}
+
+		return g.commit(ctx, "create "+candidate, func() error {
+			saved := *task
+			saved.Name = candidate
+			return g.write(&saved)
+		})
+	})
+	if err == nil {
+		task.Name = candidate
+	}
+	return
+}
+
+func (g *gitBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = g.change(ctx, "set the description of "+task.Name, func() (err error) {
+		stored, err := g.readRevision(task)
+		if err != nil {
+			return
+		}
+		stored.Description = desc
+		stored.Revision++
+		return g.write(stored)
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (g *gitBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = g.change(ctx, fmt.Sprintf("add %s to %s", a.DeltaString(), task.Name), func() (err error) {
+		stored, err := g.readRevision(task)
+		if err != nil {
+			return
+		}
+		stored.Apply(a)
+		stored.Revision++
+		return g.write(stored)
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (g *gitBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	if len(task.Annotations) == 0 {
+		err = errorf(ErrInvalidArgument, "no annotations to undo")
+		return
+	}
+
+	last := task.Annotations[len(task.Annotations)-1]
+	err = g.change(ctx, fmt.Sprintf("undo %s on %s", last.DeltaString(), task.Name), func() (err error) {
+		stored, err := g.readRevision(task)
+		if err != nil {
+			return
+		}
+		i := len(stored.Annotations) - 1
+		a := stored.Annotations[i]
+		stored.Annotations = stored.Annotations[:i]
+		stored.Estimate -= a.EstimateDelta
+		stored.Actual -= a.ActualDelta
+		stored.Revision++
+		return g.write(stored)
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (g *gitBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	task, err = g.read(name)
+	return
+}
+
+func (g *gitBackend) Start(ctx context.Context, name string) (err error) {
+	err = g.change(ctx, "start working on "+name, func() (err error) {
+		data, err := json.MarshalIndent(StartLog{
+			Name: name,
+			When: time.Now(),
+		}, "", "\t")
+		if err != nil {
+			return
+		}
+		if err = os.MkdirAll(filepath.Dir(g.timerPath()), 0700); err != nil {
+			return
+		}
+		return ioutil.WriteFile(g.timerPath(), append(data, '\n'), 0600)
+	})
+	return
+}
+
+func (g *gitBackend) Stop(ctx context.Context) (err error) {
+	err = g.change(ctx, "discard the timer", func() (err error) {
+		if err = os.Remove(g.timerPath()); os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	})
+	return
+}
+
+// StopTimer reads and removes the timer and records the time in the task in
+// one commit, holding the lock throughout.
+func (g *gitBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	var missing bool
+	err = g.locked(func() (err error) {
+		if log, err = g.readTimer(); err != nil || log == nil {
+			return
+		}
+		a := log.Annotation(when)
+		return g.commit(ctx, fmt.Sprintf("stop working on %s, adding %s", log.Name, a.DeltaString()), func() (err error) {
+			if err = os.Remove(g.timerPath()); err != nil {
+				return
+			}
+			if task, err = g.read(log.Name); isCode(err, ErrNotFound) {
+				//the task is gone. still stop the timer.
+				missing = true
+				return nil
+			}
+			if err != nil {
+				return
+			}
+			task.Apply(a)
+			task.Revision++
+			return g.write(task)
+		})
+	})
+	switch {
+	case err != nil:
+		log, task = nil, nil
+	case missing:
+		task = nil
+		err = errorf(ErrNotFound, "task %q not found", log.Name)
+	}
+	return
+}
+
+func (g *gitBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	log, err = g.readTimer()
+	return
+}
+
+func (g *gitBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "invalid regex: %s", err)
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	names, err := g.names()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if !re.MatchString(name) {
+			continue
+		}
+		var task *Task
+		if task, err = g.read(name); err != nil {
+			return
+		}
+		if annotatedIn(task, before, after) {
+			tasks = append(tasks, task)
+		}
+	}
+	return
+}
+
+func (g *gitBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = g.change(ctx, fmt.Sprintf("rename %s to %s", oldn, newn), func() (err error) {
+		task, err := g.read(oldn)
+		if err != nil {
+			return
+		}
+		if _, err := os.Stat(g.taskPath(newn)); err == nil {
+			return errorf(ErrConflict, "task %q already exists", newn)
+		}
+		task.Name = newn
+		if err = g.write(task); err != nil {
+			return
+		}
+		return os.Remove(g.taskPath(oldn))
+	})
+	return
+}
+
+func (g *gitBackend) Remove(ctx context.Context, name string) (err error) {
+	err = g.change(ctx, "remove "+name, func() (err error) {
+		if _, err = g.read(name); err != nil {
+			return
+		}
+		return os.Remove(g.taskPath(name))
+	})
+	return
+}
+
+//
+// schema versions
+//
+
+func (g *gitBackend) schema(ctx context.Context) (version int, err error) {
+	data, err := ioutil.ReadFile(g.schemaPath())
+	if err != nil {
+		return
+	}
+	version, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	return
+}
+
+// migrate rewrites the task files of every user in one commit.
+func (g *gitBackend) migrate(ctx context.Context, m migration) (err error) {
+	message := fmt.Sprintf("migrate to schema version %d: %s", m.version, m.desc)
+	err = g.change(ctx, message, func() (err error) {
+		paths, err := filepath.Glob(filepath.Join(g.dir, "tasks", "*.json"))
+		if err != nil {
+			return
+		}
+		users, err := filepath.Glob(filepath.Join(g.dir, "users", "*", "tasks", "*.json"))
+		if err != nil {
+			return
+		}
+
+		for _, path := range append(paths, users...) {
+			var data []byte
+			if data, err = ioutil.ReadFile(path); err != nil {
+				return
+			}
+			var t doc
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			if err = dec.Decode(&t); err != nil {
+				return
+			}
+			if err = m.task(t); err != nil {
+				return
+			}
+			if data, err = json.MarshalIndent(t, "", "\t"); err != nil {
+				return
+			}
+			if err = ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+				return
+			}
+		}
+		return ioutil.WriteFile(g.schemaPath(), []byte(strconv.Itoa(m.version)+"\n"), 0600)
+	})
+	return
+}
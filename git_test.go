@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGit(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+	if out, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+
+	b, err := openGit(&GitConfig{Dir: filepath.Join(dir, "a"), Remote: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+	testSave(t, b, "shared")
+
+	//a second clone sees the tasks pushed by the first
+	other, err := openGit(&GitConfig{Dir: filepath.Join(dir, "b"), Remote: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Load(context.Background(), "shared"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitFailedChange(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openGit(&GitConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := b.(*gitBackend)
+	ctx := context.Background()
+
+	err = g.change(ctx, "half done", func() error {
+		if err := ioutil.WriteFile(filepath.Join(dir, "schema"), []byte("99\n"), 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "stray.json"), []byte("{}"), 0600); err != nil {
+			return err
+		}
+		return errors.New("failed halfway")
+	})
+	if err == nil {
+		t.Fatal("the change didn't fail")
+	}
+
+	testSave(t, b, "next")
+	out, err := g.git(ctx, "show", "--name-only", "--format=", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := strings.Fields(string(out)); len(files) != 1 || !strings.HasSuffix(files[0], "next.json") {
+		t.Fatalf("the next change committed %q", files)
+	}
+	if v, err := g.schema(ctx); err != nil || v != currentSchema() {
+		t.Fatalf("schema %d %v", v, err)
+	}
+}
+
+func TestGitLocked(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openGit(&GitConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//another est in the middle of a change
+	unlock, err := lockFile(filepath.Join(dir, ".git", "est.lock"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- b.Save(context.Background(), &Task{Name: "waiting"})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("saved while the repository was locked: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
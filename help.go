@@ -16,6 +16,13 @@ func init() {
 
 		flags: flag.NewFlagSet("help", flag.ExitOnError),
 		run:   help,
+
+		complete: func(args []string, prefix string) []string {
+			if len(args) > 0 {
+				return nil
+			}
+			return commandNames()
+		},
 	}
 
 	commands["help"] = cmd
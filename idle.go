@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// TimerConfig catches timers that were left running, so a night away doesn't
+// count as work.
+type TimerConfig struct {
+	MaxSession  Duration `json:",omitempty"` //sessions longer than this are suspect. default 8h
+	Idle        Duration `json:",omitempty"` //being idle longer than this at stop is suspect. default 15m
+	IdleCommand string   `json:",omitempty"` //prints the idle time in milliseconds. default xprintidle, or ioreg on macs
+	Policy      string   `json:",omitempty"` //ask, trim or keep a suspect session. default ask
+}
+
+const (
+	defaultMaxSession = 8 * time.Hour
+	defaultIdle       = 15 * time.Minute
+)
+
+func (c *TimerConfig) validate() (problems []string) {
+	switch c.Policy {
+	case "", "ask", "trim", "keep":
+	default:
+		problems = append(problems, fmt.Sprintf("Policy %q is not one of ask, trim or keep", c.Policy))
+	}
+	if c.MaxSession < 0 || c.Idle < 0 {
+		problems = append(problems, "MaxSession and Idle can't be negative")
+	}
+	return
+}
+
+func timerConfig() *TimerConfig {
+	c := TimerConfig{}
+	if defaultConfig.Timer != nil {
+		c = *defaultConfig.Timer
+	}
+	if c.MaxSession == 0 {
+		c.MaxSession = Duration(defaultMaxSession)
+	}
+	if c.Idle == 0 {
+		c.Idle = Duration(defaultIdle)
+	}
+	if c.Policy == "" {
+		c.Policy = "ask"
+	}
+	return &c
+}
+
+var ioregIdle = regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+
+// idleTime asks the system how long since the last keyboard or mouse input.
+// ok is false if there's no way to tell.
+func (c *TimerConfig) idleTime() (idle time.Duration, ok bool) {
+	command := c.IdleCommand
+	if command == "" {
+		switch _, err := exec.LookPath("xprintidle"); {
+		case err == nil && os.Getenv("DISPLAY") != "":
+			command = "xprintidle"
+		case runtime.GOOS == "darwin":
+			out, err := exec.Command("ioreg", "-c", "IOHIDSystem").Output()
+			if m := ioregIdle.FindSubmatch(out); err == nil && m != nil {
+				ns, err := strconv.ParseInt(string(m[1]), 10, 64)
+				return time.Duration(ns), err == nil
+			}
+			return
+		default:
+			return
+		}
+	}
+
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		return
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return time.Duration(ms) * time.Millisecond, err == nil
+}
+
+// suspect tells why the running session looks like it wasn't all work, and
+// when it should have ended instead.
+func (c *TimerConfig) suspect(log *StartLog, now time.Time) (reason string, end time.Time) {
+	end = now
+	if idle, ok := c.idleTime(); ok && idle > time.Duration(c.Idle) && now.Add(-idle).After(log.When) {
+		end = now.Add(-idle)
+		reason = fmt.Sprintf("idle for the last %s", roughly(idle))
+	}
+	if max := log.When.Add(time.Duration(c.MaxSession)); end.After(max) {
+		end = max
+		reason = fmt.Sprintf("running for %s, longer than %s", roughly(now.Sub(log.When)), time.Duration(c.MaxSession))
+	}
+	return
+}
+
+// roughly rounds a duration to minutes, or to seconds if it's shorter.
+func roughly(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(time.Second)
+	}
+	return d.Round(time.Minute)
+}
+
+// stopRunning stops the running timer, first trimming a session that ran
+// too long or ended idle as the policy says. it returns a nil log if no timer
+// was running.
+func stopRunning(ctx context.Context) (log *StartLog, task *Task, err error) {
+	if log, err = defaultBackend.Status(ctx); err != nil || log == nil {
+		return
+	}
+	now := time.Now()
+	end := now
+
+	c := timerConfig()
+	if reason, trimmed := c.suspect(log, now); reason != "" {
+		policy := c.Policy
+		if policy == "ask" && !term.IsTerminal(int(os.Stdin.Fd())) {
+			policy = "keep"
+		}
+
+		full, short := now.Sub(log.When).Round(time.Second), trimmed.Sub(log.When).Round(time.Second)
+		fmt.Printf("the timer on %s was %s\n", log.Name, reason)
+		switch policy {
+		case "trim":
+			fmt.Println("trimming it to", short)
+			end = trimmed
+		case "keep":
+			fmt.Println("keeping all", full, "of it. use undo and add to fix it")
+		case "ask":
+			end = askSessionEnd(log, full, short, trimmed, now)
+		}
+	}
+
+	return defaultBackend.StopTimer(ctx, end)
+}
+
+// askSessionEnd asks how much of the session to record.
+func askSessionEnd(log *StartLog, full, short time.Duration, trimmed, now time.Time) time.Time {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("record [t]rimmed %s, [a]ll %s or a duration: ", short, full)
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			return now
+		}
+		switch line = strings.TrimSpace(line); line {
+		case "", "t":
+			return trimmed
+		case "a":
+			return now
+		}
+		if d, err := time.ParseDuration(line); err == nil && d >= 0 {
+			if d > full {
+				return now
+			}
+			return log.When.Add(d)
+		}
+		fmt.Println("enter t, a or a duration like 1h30m")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// a lock file keeps ests from changing the same files at the same time. the
+// lock is held on an open file, so it goes away with the process that holds
+// it.
+const (
+	defaultLockTimeout = 5 * time.Second
+	lockRetry          = 50 * time.Millisecond
+)
+
+// errLocked is returned by tryLock when another open file holds the lock.
+var errLocked = errors.New("locked")
+
+// lockFile takes the lock on the file at path, creating it if needed, and
+// waits up to timeout for whoever holds it. unlock releases it.
+func lockFile(path string, timeout time.Duration) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if err = tryLock(f); err != errLocked || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(lockRetry)
+	}
+	if err == errLocked {
+		err = errorf(ErrUnavailable, "%s is in use by another est", path)
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	//closing the file releases the lock
+	unlock = func() { f.Close() }
+	return
+}
@@ -131,7 +131,7 @@ func log(c *command) {
 		high.update(startWeek.AddDate(0, 0, 7))
 	}
 
-	tasks, err := defaultBackend.Find(regex, low.time(), high.time())
+	tasks, err := defaultBackend.Find(c.ctx, regex, low.time(), high.time())
 	if err != nil {
 		c.Error(err)
 	}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// health and metrics endpoints for serve
+//
+
+func init() {
+	http.HandleFunc("/healthz", serveHealth)
+	http.HandleFunc("/metrics", serveMetricsPage)
+}
+
+// healthTimeout bounds how long the health check waits on the backend.
+const healthTimeout = 5 * time.Second
+
+func serveHealth(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+	defer cancel()
+
+	//not every backend can abandon a call when the context is done, so
+	//don't wait on it past the timeout
+	errs := make(chan error, 1)
+	go func() {
+		_, err := defaultBackend.Status(ctx)
+		errs <- err
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("backend did not respond within %s", healthTimeout)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveMetricsPage needs an admin token when serve has a user store, since the
+// gauges add up the data of every user.
+func serveMetricsPage(w http.ResponseWriter, req *http.Request) {
+	if serveUsers != nil {
+		user, _, err := serveUsers.requestUser(req)
+		if err == nil && !user.Admin {
+			err = errorf(ErrUnauthorized, "user %q may not read the metrics of every user", user.Name)
+		}
+		if err != nil {
+			serveLog.Warn("metrics", "remote", req.RemoteAddr, "error", err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rpcMetrics.write(w)
+	writeBackendGauges(req.Context(), w)
+}
+
+//
+// per method rpc metrics
+//
+
+// latencyBuckets are the upper bounds in seconds of the latency histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var rpcMetrics = &metrics{methods: map[string]*methodMetrics{}}
+
+type metrics struct {
+	mu      sync.Mutex
+	methods map[string]*methodMetrics
+}
+
+type methodMetrics struct {
+	calls   uint64
+	errors  uint64
+	buckets []uint64 //count of calls that fit in each bucket but not the one before
+	sum     float64
+}
+
+func (m *metrics) observe(method string, latency time.Duration, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mm, ok := m.methods[method]
+	if !ok {
+		mm = &methodMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.methods[method] = mm
+	}
+
+	mm.calls++
+	if failed {
+		mm.errors++
+	}
+	secs := latency.Seconds()
+	mm.sum += secs
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			mm.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.methods))
+	for name := range m.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP est_rpc_calls_total Number of rpc calls handled.")
+	fmt.Fprintln(w, "# TYPE est_rpc_calls_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "est_rpc_calls_total{method=%q} %d\n", name, m.methods[name].calls)
+	}
+
+	fmt.Fprintln(w, "# HELP est_rpc_errors_total Number of rpc calls that returned an error.")
+	fmt.Fprintln(w, "# TYPE est_rpc_errors_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "est_rpc_errors_total{method=%q} %d\n", name, m.methods[name].errors)
+	}
+
+	fmt.Fprintln(w, "# HELP est_rpc_latency_seconds Latency of rpc calls.")
+	fmt.Fprintln(w, "# TYPE est_rpc_latency_seconds histogram")
+	for _, name := range names {
+		mm := m.methods[name]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += mm.buckets[i]
+			fmt.Fprintf(w, "est_rpc_latency_seconds_bucket{method=%q,le=\"%g\"} %d\n", name, le, cumulative)
+		}
+		fmt.Fprintf(w, "est_rpc_latency_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", name, mm.calls)
+		fmt.Fprintf(w, "est_rpc_latency_seconds_sum{method=%q} %g\n", name, mm.sum)
+		fmt.Fprintf(w, "est_rpc_latency_seconds_count{method=%q} %d\n", name, mm.calls)
+	}
+}
+
+//
+// gauges read from the backend on every scrape
+//
+
+// writeBackendGauges reports the number of tasks and running timers, summed
+// over every user when serve has a user store.
+func writeBackendGauges(ctx context.Context, w io.Writer) {
+	backends := []Backend{defaultBackend}
+	if serveUsers != nil {
+		backends = backends[:0]
+		for _, u := range serveUsers.users {
+			backends = append(backends, defaultBackend.(namespacer).Namespace(u.Name))
+		}
+	}
+
+	var tasks, timers int
+	var failed bool
+	for _, b := range backends {
+		found, err := allTasks(ctx, b)
+		if err != nil {
+			failed = true
+			break
+		}
+		tasks += len(found)
+
+		log, err := b.Status(ctx)
+		if err != nil {
+			failed = true
+			break
+		}
+		if log != nil {
+			timers++
+		}
+	}
+
+	up := 1
+	if failed {
+		up = 0
+	}
+	fmt.Fprintln(w, "# HELP est_backend_up Whether the backend answered the last scrape.")
+	fmt.Fprintln(w, "# TYPE est_backend_up gauge")
+	fmt.Fprintf(w, "est_backend_up %d\n", up)
+	if failed {
+		return
+	}
+
+	fmt.Fprintln(w, "# HELP est_tasks Number of tasks.")
+	fmt.Fprintln(w, "# TYPE est_tasks gauge")
+	fmt.Fprintf(w, "est_tasks %d\n", tasks)
+	fmt.Fprintln(w, "# HELP est_running_timers Number of timers currently running.")
+	fmt.Fprintln(w, "# TYPE est_running_timers gauge")
+	fmt.Fprintf(w, "est_running_timers %d\n", timers)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsNeedAdmin(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(dir, "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultBackend = b
+	testSave(t, b.(namespacer).Namespace("alice"), "hers")
+
+	path := filepath.Join(dir, "users")
+	users := `[{"Name":"alice","Token":"` + hashToken("a") + `"},{"Name":"root","Token":"` + hashToken("r") + `","Admin":true}]`
+	if err := os.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if serveUsers, err = loadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { serveUsers = nil }()
+
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+	for token, want := range map[string]int{"": 401, "a": 401, "r": 200} {
+		req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q got %s, want %d", token, resp.Status, want)
+		}
+		if want == 200 && !strings.Contains(string(body), "est_tasks 1\n") {
+			t.Errorf("metrics without alice's task:\n%s", body)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+//
+// schema versions: stored data records the version of its shape, and
+// migrations move it forward one version at a time
+//
+
+// migration moves stored tasks to version. task changes one task, given as
+// the generic document the backend stored so it works whatever shape the
+// task had.
+type migration struct {
+	version int
+	desc    string
+	task    func(t doc) error
+}
+
+// migrations are in order of version. data stored before schema versions
+// existed is version 1.
+var migrations = []migration{
+	{2, "recompute task totals from annotations", recomputeTotals},
+}
+
+func currentSchema() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrator is implemented by backends that store a schema version.
+type migrator interface {
+	//schema returns the version of the stored data. empty stores are at the
+	//current version.
+	schema(ctx context.Context) (version int, err error)
+	//migrate applies m to every task and records m.version.
+	migrate(ctx context.Context, m migration) (err error)
+}
+
+// checkSchema makes sure est understands the stored data before using it.
+func checkSchema(ctx context.Context, b migrator) (err error) {
+	v, err := b.schema(ctx)
+	switch {
+	case err != nil:
+	case v > currentSchema():
+		err = errorf(ErrInvalidArgument, "stored data is at schema version %d but this est only knows up to %d. upgrade est", v, currentSchema())
+	case v < currentSchema():
+		err = errorf(ErrInvalidArgument, "stored data is at schema version %d but this est needs %d. run 'est db upgrade'", v, currentSchema())
+	}
+	return
+}
+
+// upgradeSchema runs the migrations the stored data hasn't had, calling
+// report before each.
+func upgradeSchema(ctx context.Context, b migrator, report func(m migration)) (err error) {
+	v, err := b.schema(ctx)
+	if err != nil {
+		return
+	}
+	for _, m := range migrations {
+		if m.version <= v {
+			continue
+		}
+		report(m)
+		if err = b.migrate(ctx, m); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//
+// the migrations
+//
+
+// recomputeTotals fixes tasks written when adding an annotation only
+// incremented one of the totals.
+func recomputeTotals(t doc) (err error) {
+	var estimate, actual int64
+	for _, a := range t.list("annotations") {
+		estimate += docInt(a.get("estimatedelta"))
+		actual += docInt(a.get("actualdelta"))
+	}
+	t.set("estimate", estimate)
+	t.set("actual", actual)
+	return
+}
+
+//
+// generic documents
+//
+
+// doc is a stored task decoded without a schema. keys are matched ignoring
+// case, since the bson encoding lowercases field names and json doesn't.
+type doc map[string]interface{}
+
+func (t doc) key(name string) string {
+	for k := range t {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+func (t doc) get(name string) interface{} {
+	return t[t.key(name)]
+}
+
+// set replaces the value under the key the document already uses.
+func (t doc) set(name string, v interface{}) {
+	t[t.key(name)] = v
+}
+
+// list returns the documents in an array field.
+func (t doc) list(name string) (docs []doc) {
+	items, _ := t.get(name).([]interface{})
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			docs = append(docs, doc(m))
+		}
+	}
+	return
+}
+
+// docInt reads a number however the encoding decoded it.
+func docInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	case json.Number:
+		x, _ := n.Int64()
+		return x
+	case time.Duration:
+		return int64(n)
+	}
+	return 0
+}
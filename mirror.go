@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// MirrorConfig writes to a primary backend and copies every change to the
+// secondaries, for moving from one backend to another.
+type MirrorConfig struct {
+	Primary     *Config
+	Secondaries []*Config
+	Log         string `json:",omitempty"` //file recording changes a secondary missed. default $HOME/.est-divergence
+}
+
+func (c *MirrorConfig) validate() (problems []string) {
+	if c.Primary == nil || len(c.Secondaries) == 0 {
+		problems = append(problems, "a Primary and at least one of the Secondaries are required")
+	}
+	if c.Primary != nil {
+		for _, p := range validateConfig(c.Primary) {
+			problems = append(problems, "Primary: "+p)
+		}
+	}
+	for i, s := range c.Secondaries {
+		for _, p := range validateConfig(s) {
+			problems = append(problems, fmt.Sprintf("Secondaries %d: %s", i+1, p))
+		}
+	}
+	return
+}
+
+func init() {
+	backendTypes["mirror"] = &backendType{
+		section: "MirrorConfig",
+		config:  func() interface{} { return &MirrorConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openMirror(conf.(*MirrorConfig)) },
+	}
+}
+
+func openMirror(c *MirrorConfig) (b Backend, err error) {
+	if c.Primary == nil || len(c.Secondaries) == 0 {
+		err = errorf(ErrInvalidArgument, "mirror needs a primary and at least one secondary")
+		return
+	}
+
+	m := &mirrorBackend{log: c.Log}
+	if m.log == "" {
+		m.log = os.ExpandEnv("$HOME/.est-divergence")
+	}
+	for i, conf := range append([]*Config{c.Primary}, c.Secondaries...) {
+		var mb Backend
+		mb, err = openBackend(conf)
+		name := "primary"
+		if i > 0 {
+			name = fmt.Sprintf("secondary %d", i)
+		}
+		name = fmt.Sprintf("%s (%s)", name, conf.Backend)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			return
+		}
+		m.backends = append(m.backends, mb)
+		m.names = append(m.names, name)
+	}
+
+	//serving users needs every backend to keep users apart
+	b = &namespacedMirror{m}
+	for _, mb := range m.backends {
+		if _, ok := mb.(namespacer); !ok {
+			b = m
+		}
+	}
+	return
+}
+
+type mirrorBackend struct {
+	backends []Backend //the primary then the secondaries
+	names    []string
+	log      string
+	user     string
+}
+
+type namespacedMirror struct {
+	*mirrorBackend
+}
+
+func (n *namespacedMirror) Namespace(user string) Backend {
+	m := *n.mirrorBackend
+	m.backends = nil
+	for _, b := range n.backends {
+		m.backends = append(m.backends, b.(namespacer).Namespace(user))
+	}
+	m.user = user
+	return &m
+}
+
+// asMirror returns the mirror if b is one.
+func asMirror(b Backend) (m *mirrorBackend, ok bool) {
+	switch x := b.(type) {
+	case *mirrorBackend:
+		return x, true
+	case *namespacedMirror:
+		return x.mirrorBackend, true
+	}
+	return
+}
+
+// checkSchemas checks the schema of each backend that has one.
+func (m *mirrorBackend) checkSchemas(ctx context.Context) (err error) {
+	for i, b := range m.backends {
+		if mg, ok := b.(migrator); ok {
+			if err = checkSchema(ctx, mg); err != nil {
+				return fmt.Errorf("%s: %w", m.names[i], err)
+			}
+		}
+	}
+	return
+}
+
+func (m *mirrorBackend) primary() Backend {
+	return m.backends[0]
+}
+
+// divergence is a change that a secondary failed to make, logged as a line
+// of json.
+type divergence struct {
+	When      time.Time
+	Backend   string
+	User      string `json:",omitempty"`
+	Operation string
+	Task      string `json:",omitempty"`
+	Error     string
+}
+
+// diverged records that the secondary failed to make the change. the change
+// was made on the primary, so the caller doesn't fail.
+func (m *mirrorBackend) diverged(i int, op, task string, err error) {
+	fmt.Fprintf(os.Stderr, "warning: %s did not %s: %s\n", m.names[i], op, err)
+
+	data, _ := json.Marshal(divergence{
+		When:      time.Now(),
+		Backend:   m.names[i],
+		User:      m.user,
+		Operation: op,
+		Task:      task,
+		Error:     err.Error(),
+	})
+	f, ferr := os.OpenFile(m.log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr != nil {
+		fmt.Fprintf(os.Stderr, "warning: unable to record it in %s: %s\n", m.log, ferr)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// mirror makes a change on the primary and then on each secondary, recording
+// the secondaries that fail.
+func (m *mirrorBackend) mirror(op, task string, primary func(b Backend) error, secondary func(b Backend) error) (err error) {
+	if err = primary(m.primary()); err != nil {
+		return
+	}
+	for i, b := range m.backends[1:] {
+		if serr := secondary(b); serr != nil {
+			m.diverged(i+1, op, task, serr)
+		}
+	}
+	return
+}
+
+// current loads the secondary's copy of the task. changes are checked
+// against the revision on the primary, and the secondary's revision can
+// differ from it.
+func current(ctx context.Context, b Backend, name string, fn func(task *Task) error) (err error) {
+	task, err := b.Load(ctx, name)
+	if err == nil {
+		err = fn(task)
+	}
+	return
+}
+
+//
+// Backend
+//
+
+func (m *mirrorBackend) Save(ctx context.Context, task *Task) (err error) {
+	err = m.mirror("create", task.Name, func(b Backend) error {
+		return b.Save(ctx, task)
+	}, func(b Backend) (err error) {
+		copied := copyTask(task)
+		if err = b.Save(ctx, copied); err == nil && copied.Name != task.Name {
+			err = fmt.Errorf("saved as %q instead of %q", copied.Name, task.Name)
+		}
+		return
+	})
+	return
+}
+
+func (m *mirrorBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = m.mirror("set the description", task.Name, func(b Backend) error {
+		return b.SetDescription(ctx, task, desc)
+	}, func(b Backend) error {
+		return current(ctx, b, task.Name, func(t *Task) error {
+			return b.SetDescription(ctx, t, desc)
+		})
+	})
+	return
+}
+
+func (m *mirrorBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = m.mirror("add an annotation", task.Name, func(b Backend) error {
+		return b.AddAnnotation(ctx, task, a)
+	}, func(b Backend) error {
+		return current(ctx, b, task.Name, func(t *Task) error {
+			return b.AddAnnotation(ctx, t, a)
+		})
+	})
+	return
+}
+
+func (m *mirrorBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	err = m.mirror("undo an annotation", task.Name, func(b Backend) error {
+		return b.PopAnnotation(ctx, task)
+	}, func(b Backend) error {
+		return current(ctx, b, task.Name, func(t *Task) error {
+			return b.PopAnnotation(ctx, t)
+		})
+	})
+	return
+}
+
+func (m *mirrorBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	return m.primary().Load(ctx, name)
+}
+
+func (m *mirrorBackend) Start(ctx context.Context, name string) (err error) {
+	err = m.mirror("start the timer", name, func(b Backend) error {
+		return b.Start(ctx, name)
+	}, func(b Backend) error {
+		return b.Start(ctx, name)
+	})
+	return
+}
+
+func (m *mirrorBackend) Stop(ctx context.Context) (err error) {
+	err = m.mirror("stop the timer", "", func(b Backend) error {
+		return b.Stop(ctx)
+	}, func(b Backend) error {
+		return b.Stop(ctx)
+	})
+	return
+}
+
+// StopTimer stops the timer on the primary, and copies the annotation it
+// recorded to the secondaries so the times match exactly.
+func (m *mirrorBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	var perr error
+	err = m.mirror("stop the timer", "", func(b Backend) (err error) {
+		log, task, perr = b.StopTimer(ctx, when)
+		if log != nil && isCode(perr, ErrNotFound) {
+			//the timer stopped even though its task is gone
+			return
+		}
+		return perr
+	}, func(b Backend) (err error) {
+		if err = b.Stop(ctx); err != nil || task == nil {
+			return
+		}
+		a := task.Annotations[len(task.Annotations)-1]
+		return current(ctx, b, task.Name, func(t *Task) error {
+			return b.AddAnnotation(ctx, t, a)
+		})
+	})
+	if err == nil {
+		err = perr
+	}
+	return
+}
+
+func (m *mirrorBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	return m.primary().Status(ctx)
+}
+
+func (m *mirrorBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	return m.primary().Find(ctx, regex, before, after)
+}
+
+func (m *mirrorBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = m.mirror("rename", oldn, func(b Backend) error {
+		return b.Rename(ctx, oldn, newn)
+	}, func(b Backend) error {
+		return b.Rename(ctx, oldn, newn)
+	})
+	return
+}
+
+func (m *mirrorBackend) Remove(ctx context.Context, name string) (err error) {
+	err = m.mirror("remove", name, func(b Backend) error {
+		return b.Remove(ctx, name)
+	}, func(b Backend) error {
+		return b.Remove(ctx, name)
+	})
+	return
+}
+
+// verify compares each secondary to the primary task by task, and reports the
+// differences found.
+func (m *mirrorBackend) verify(ctx context.Context, report func(backend, task, diff string)) (n int, err error) {
+	all := func(b Backend) (tasks map[string]*Task, names []string, log *StartLog, err error) {
+		found, err := allTasks(ctx, b)
+		if err != nil {
+			return
+		}
+		tasks = map[string]*Task{}
+		for _, t := range found {
+			tasks[t.Name] = t
+			names = append(names, t.Name)
+		}
+		sort.Strings(names)
+		log, err = b.Status(ctx)
+		return
+	}
+	diff := func(backend, task, format string, args ...interface{}) {
+		n++
+		report(backend, task, fmt.Sprintf(format, args...))
+	}
+
+	primary, pnames, plog, err := all(m.primary())
+	if err != nil {
+		return
+	}
+	for i, b := range m.backends[1:] {
+		name := m.names[i+1]
+		tasks, names, log, err := all(b)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", name, err)
+		}
+
+		for _, pn := range pnames {
+			p := primary[pn]
+			t, ok := tasks[p.Name]
+			if !ok {
+				diff(name, p.Name, "missing")
+				continue
+			}
+			if t.Description != p.Description {
+				diff(name, p.Name, "description is %q instead of %q", t.Description, p.Description)
+			}
+			if t.Estimate != p.Estimate {
+				diff(name, p.Name, "estimate is %s instead of %s", t.Estimate, p.Estimate)
+			}
+			if t.Actual != p.Actual {
+				diff(name, p.Name, "actual is %s instead of %s", t.Actual, p.Actual)
+			}
+			if len(t.Annotations) != len(p.Annotations) {
+				diff(name, p.Name, "has %d annotations instead of %d", len(t.Annotations), len(p.Annotations))
+				continue
+			}
+			for j := range p.Annotations {
+				if !sameAnnotation(t.Annotations[j], p.Annotations[j]) {
+					diff(name, p.Name, "annotation %d differs", j+1)
+				}
+			}
+		}
+		for _, tn := range names {
+			if _, ok := primary[tn]; !ok {
+				diff(name, tn, "not on the primary")
+			}
+		}
+
+		switch {
+		case plog == nil && log != nil:
+			diff(name, log.Name, "timer is running")
+		case plog != nil && log == nil:
+			diff(name, plog.Name, "timer is not running")
+		case plog != nil && log.Name != plog.Name:
+			diff(name, log.Name, "timer is running instead of on %q", plog.Name)
+		}
+	}
+	return
+}
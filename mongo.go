@@ -1,19 +1,43 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"net"
 	"net/url"
+	"strings"
 	"time"
 )
 
 type MongoConfig struct {
-	Host     string `json:",omitempty"`
-	Port     string `json:",omitempty"`
-	Username string `json:",omitempty"`
-	Password string `json:",omitempty"`
-	Database string `json:",omitempty"`
+	Host     string  `json:",omitempty"`
+	Port     string  `json:",omitempty"`
+	Username string  `json:",omitempty"`
+	Password *Secret `json:",omitempty"`
+	Database string  `json:",omitempty"`
+
+	Timeouts
+}
+
+func (c *MongoConfig) validate() (problems []string) {
+	if c.Host == "" {
+		problems = append(problems, "Host is required")
+	}
+	if c.Password.isSet() && c.Username == "" {
+		problems = append(problems, "Password is set without a Username")
+	}
+	return append(problems, c.Timeouts.validate()...)
+}
+
+func init() {
+	backendTypes["mongo"] = &backendType{
+		section: "MongoConfig",
+		config:  func() interface{} { return &MongoConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openMongo(conf.(*MongoConfig)) },
+	}
 }
 
 func openMongo(c *MongoConfig) (b Backend, err error) {
@@ -23,24 +47,36 @@ func openMongo(c *MongoConfig) (b Backend, err error) {
 		Host:   c.Host,
 	}
 
+	password, err := c.Password.reveal()
+	if err != nil {
+		return
+	}
+
 	//only add credentials and database in the url if they're specified
-	if c.Username != "" && c.Password == "" {
+	if c.Username != "" && password == "" {
 		u.User = url.User(c.Username)
 		u.Path = "/" + c.Database
 	}
-	if c.Username != "" && c.Password != "" {
-		u.User = url.UserPassword(c.Username, c.Password)
+	if c.Username != "" && password != "" {
+		u.User = url.UserPassword(c.Username, password)
 		u.Path = "/" + c.Database
 	}
 
-	s, err := mgo.Dial(u.String())
+	s, err := mgo.DialWithTimeout(u.String(), c.dialTimeout())
 	if err != nil {
-		err = fmt.Errorf("dial %s: %s", u, err)
+		err = errorf(ErrUnavailable, "dial %s: %s", u.Redacted(), err)
 		return
 	}
+
+	//mgo can't abandon a call when its context is done, so bound how long
+	//any one call can block instead
+	s.SetSyncTimeout(c.dialTimeout())
+	s.SetSocketTimeout(c.callTimeout())
+
 	b = &mongoBackend{
 		tasks:    s.DB(c.Database).C("tasks"),
 		startlog: s.DB(c.Database).C("startlog"),
+		timeouts: c.Timeouts,
 	}
 	return
 }
@@ -48,114 +84,401 @@ func openMongo(c *MongoConfig) (b Backend, err error) {
 type mongoBackend struct {
 	tasks    *mgo.Collection
 	startlog *mgo.Collection
+	timeouts Timeouts
 }
 
 type d map[string]interface{}
 
-func (m *mongoBackend) Save(task *Task) (err error) {
-	//while theres a task with this name, increment the number on the end of it
-	candidate := task.Name
-	for i := 1; ; i++ {
+// mongoError gives a code to the errors from mgo. name is the task the
+// operation was on.
+func mongoError(e *error, name string) {
+	err := *e
+	if err == nil || errorCode(err) != "" {
+		return
+	}
+	_, isNet := err.(net.Error)
+	switch {
+	case err == mgo.ErrNotFound:
+		*e = errorf(ErrNotFound, "task %q not found", name)
+	case mgo.IsDup(err):
+		*e = errorf(ErrConflict, "task %q already exists", name)
+	case isNet, err == io.EOF, strings.Contains(err.Error(), "no reachable servers"):
+		*e = errorf(ErrUnavailable, "mongo: %s", err)
+	}
+}
+
+// Namespace returns a backend with its own tasks and startlog collections for
+// the user.
+func (m *mongoBackend) Namespace(user string) Backend {
+	db := m.tasks.Database
+	return &mongoBackend{
+		tasks:    db.C("tasks." + user),
+		startlog: db.C("startlog." + user),
+		timeouts: m.timeouts,
+	}
+}
+
+// do runs fn unless the context is already done and gives a code to any
+// error. name is the task the operation is on.
+func (m *mongoBackend) do(ctx context.Context, name string, fn func() error) (err error) {
+	defer mongoError(&err, name)
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = fn()
+	return
+}
+
+// update applies ch to the task only if it is still at the revision it was
+// loaded at, moving it to the next one. tasks saved before revisions have
+// none stored, which is revision 0.
+func (m *mongoBackend) update(task *Task, ch bson.D) (err error) {
+	query := d{"name": task.Name, "revision": task.Revision}
+	if task.Revision == 0 {
+		query["revision"] = d{"$exists": false}
+	}
+	err = m.tasks.Update(query, ch)
+	if err == mgo.ErrNotFound {
+		//tell a task that changed apart from one that is gone
 		var n int
-		n, err = m.tasks.Find(d{"name": candidate}).Count()
-		if err != nil {
-			return
-		}
-		if n == 0 {
-			task.Name = candidate
-			break
+		if n, err = m.tasks.Find(d{"name": task.Name}).Count(); err == nil {
+			err = mgo.ErrNotFound
+			if n > 0 {
+				err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+			}
 		}
-		candidate = fmt.Sprintf("%s%d", task.Name, i)
 	}
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (m *mongoBackend) Save(ctx context.Context, task *Task) (err error) {
+	err = m.do(ctx, task.Name, func() (err error) {
+		//while theres a task with this name, increment the number on the end of it
+		candidate := task.Name
+		for i := 1; ; i++ {
+			var n int
+			n, err = m.tasks.Find(d{"name": candidate}).Count()
+			if err != nil {
+				return
+			}
+			if n == 0 {
+				task.Name = candidate
+				break
+			}
+			candidate = fmt.Sprintf("%s%d", task.Name, i)
+		}
 
-	err = m.tasks.Insert(task)
+		err = m.tasks.Insert(task)
+		return
+	})
 	return
 }
 
-func (m *mongoBackend) Load(name string) (task *Task, err error) {
-	task = new(Task)
-	err = m.tasks.Find(d{"name": name}).One(task)
+func (m *mongoBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	err = m.timeouts.retry(ctx, func(ctx context.Context) error {
+		return m.do(ctx, name, func() error {
+			task = new(Task)
+			return m.tasks.Find(d{"name": name}).One(task)
+		})
+	})
 	return
 }
 
-func (m *mongoBackend) SetDescription(task *Task, desc string) (err error) {
-	ch := bson.D{
-		{"$set", d{"description": desc}},
-	}
-	err = m.tasks.Update(d{"name": task.Name}, ch)
+func (m *mongoBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = m.do(ctx, task.Name, func() error {
+		ch := bson.D{
+			{"$set", d{"description": desc}},
+			{"$inc", d{"revision": 1}},
+		}
+		return m.update(task, ch)
+	})
 	return
 }
 
-func (m *mongoBackend) AddAnnotation(task *Task, a Annotation) (err error) {
-	//create the change document
-	ch := bson.D{
-		{"$push", d{"annotations": a}},
-		{"$inc", d{"estimate": a.EstimateDelta}},
-		{"$inc", d{"actual": a.ActualDelta}},
-	}
-	err = m.tasks.Update(d{"name": task.Name}, ch)
+func (m *mongoBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = m.do(ctx, task.Name, func() error {
+		//create the change document
+		ch := bson.D{
+			{"$push", d{"annotations": a}},
+			{"$inc", d{"estimate": a.EstimateDelta, "actual": a.ActualDelta, "revision": 1}},
+		}
+		return m.update(task, ch)
+	})
 	return
 }
 
-func (m *mongoBackend) PopAnnotation(task *Task) (err error) {
+func (m *mongoBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
 	if len(task.Annotations) == 0 {
-		err = fmt.Errorf("no annotations to undo")
+		err = errorf(ErrInvalidArgument, "no annotations to undo")
+		return
 	}
 
-	//get the last annotation and negate it
-	a := task.Annotations[len(task.Annotations)-1].Negate()
+	err = m.do(ctx, task.Name, func() error {
+		//get the last annotation and negate it. the revision check makes sure
+		//it is still the last one
+		a := task.Annotations[len(task.Annotations)-1].Negate()
 
-	//create the change document
-	ch := bson.D{
-		{"$pop", d{"annotations": 1}},
-		{"$inc", d{"estimate": a.EstimateDelta}},
-		{"$inc", d{"actual": a.ActualDelta}},
-	}
-	err = m.tasks.Update(d{"name": task.Name}, ch)
+		//create the change document
+		ch := bson.D{
+			{"$pop", d{"annotations": 1}},
+			{"$inc", d{"estimate": a.EstimateDelta, "actual": a.ActualDelta, "revision": 1}},
+		}
+		return m.update(task, ch)
+	})
 	return
 }
 
-func (m *mongoBackend) Rename(oldn, newn string) (err error) {
-	ch := d{"$set": d{"name": newn}}
-	err = m.tasks.Update(d{"name": oldn}, ch)
+func (m *mongoBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = m.do(ctx, oldn, func() error {
+		n, err := m.tasks.Find(d{"name": newn}).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errorf(ErrConflict, "task %q already exists", newn)
+		}
+
+		ch := d{"$set": d{"name": newn}}
+		return m.tasks.Update(d{"name": oldn}, ch)
+	})
 	return
 }
 
-func (m *mongoBackend) Remove(name string) (err error) {
-	err = m.tasks.Remove(d{"name": name})
+func (m *mongoBackend) Remove(ctx context.Context, name string) (err error) {
+	err = m.do(ctx, name, func() error {
+		return m.tasks.Remove(d{"name": name})
+	})
 	return
 }
 
-func (m *mongoBackend) Start(name string) (err error) {
-	err = m.startlog.Insert(StartLog{
-		Name: name,
-		When: time.Now(),
+func (m *mongoBackend) Start(ctx context.Context, name string) (err error) {
+	err = m.do(ctx, name, func() error {
+		return m.startlog.Insert(StartLog{
+			Name: name,
+			When: time.Now(),
+		})
 	})
 	return
 }
 
-func (m *mongoBackend) Stop() (err error) {
-	_, err = m.startlog.RemoveAll(nil)
+func (m *mongoBackend) Stop(ctx context.Context) (err error) {
+	err = m.do(ctx, "", func() (err error) {
+		_, err = m.startlog.RemoveAll(nil)
+		return
+	})
 	return
 }
 
-func (m *mongoBackend) Status() (log *StartLog, err error) {
-	n, err := m.startlog.Count()
-	if err != nil {
+// mongoStartLog is a startlog document. Stopping is set when a stop claims
+// the timer, so a stop that dies before removing it can be finished by the
+// next one.
+type mongoStartLog struct {
+	Id       bson.ObjectId `bson:"_id"`
+	Name     string
+	When     time.Time
+	Stopping time.Time `bson:",omitempty"`
+}
+
+// running matches the timer that no stop has claimed.
+var running = d{"stopping": d{"$exists": false}}
+
+// StopTimer stops in two phases since mongo can't update the startlog and
+// the task together: the timer is claimed by setting its stop time, then the
+// annotation is added and the timer removed. both steps can be repeated, so
+// a claimed timer left behind by a failed stop is finished first.
+func (m *mongoBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	//mongo keeps milliseconds, and the annotation is matched on its time
+	when = when.Truncate(time.Millisecond)
+
+	err = m.do(ctx, "", func() (err error) {
+		var claimed []mongoStartLog
+		if err = m.startlog.Find(d{"stopping": d{"$exists": true}}).All(&claimed); err != nil {
+			return
+		}
+		for _, l := range claimed {
+			if err = m.finishStop(l); err != nil {
+				return
+			}
+		}
+
+		var l mongoStartLog
+		_, err = m.startlog.Find(running).Apply(mgo.Change{
+			Update:    d{"$set": d{"stopping": when}},
+			ReturnNew: true,
+		}, &l)
+		if err == mgo.ErrNotFound {
+			//no timer running
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err = m.finishStop(l); err != nil {
+			return
+		}
+
+		log = &StartLog{Name: l.Name, When: l.When}
+		task = new(Task)
+		err = m.tasks.Find(d{"name": l.Name}).One(task)
+		mongoError(&err, l.Name)
+		return
+	})
+	return
+}
+
+// finishStop adds the annotation for a claimed timer unless it is already
+// there, and removes the timer.
+func (m *mongoBackend) finishStop(l mongoStartLog) (err error) {
+	a := StartLog{Name: l.Name, When: l.When}.Annotation(l.Stopping)
+	err = m.tasks.Update(d{"name": l.Name, "annotations.when": d{"$ne": a.When}}, bson.D{
+		{"$push", d{"annotations": a}},
+		{"$inc", d{"actual": a.ActualDelta, "revision": 1}},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		//not found means it was already added or the task is gone
 		return
 	}
-	if n == 0 {
+	err = m.startlog.RemoveId(l.Id)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (m *mongoBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	err = m.timeouts.retry(ctx, func(ctx context.Context) error {
+		return m.do(ctx, "", func() (err error) {
+			log = new(StartLog)
+			err = m.startlog.Find(running).One(log)
+			if err == mgo.ErrNotFound {
+				log, err = nil, nil
+			}
+			return
+		})
+	})
+	return
+}
+
+func (m *mongoBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	err = m.timeouts.retry(ctx, func(ctx context.Context) error {
+		return m.do(ctx, "", func() error {
+			tasks = nil
+			query := d{"name": d{"$regex": regex}}
+			if !findsAll(before, after) {
+				query["annotations.when"] = d{"$lt": after, "$gte": before}
+			}
+			return m.tasks.Find(query).All(&tasks)
+		})
+	})
+	return
+}
+
+//
+// schema versions
+//
+
+// meta holds the schema version, which covers the collections of every user
+// in the database.
+func (m *mongoBackend) meta() *mgo.Collection {
+	return m.tasks.Database.C("meta")
+}
+
+func (m *mongoBackend) taskCollections() (cols []*mgo.Collection, err error) {
+	names, err := m.tasks.Database.CollectionNames()
+	if err != nil {
 		return
 	}
-	log = new(StartLog)
-	err = m.startlog.Find(nil).One(log)
+	for _, name := range names {
+		if name == "tasks" || strings.HasPrefix(name, "tasks.") {
+			cols = append(cols, m.tasks.Database.C(name))
+		}
+	}
 	return
 }
 
-func (m *mongoBackend) Find(regex string, before, after time.Time) (tasks []*Task, err error) {
-	err = m.tasks.Find(d{
-		"name":             d{"$regex": regex},
-		"annotations.when": d{"$lt": after, "$gte": before},
-	}).All(&tasks)
+func (m *mongoBackend) schema(ctx context.Context) (version int, err error) {
+	err = m.do(ctx, "", func() (err error) {
+		var meta struct{ Version int }
+		err = m.meta().FindId("schema").One(&meta)
+		if err != mgo.ErrNotFound {
+			version = meta.Version
+			return
+		}
+
+		//nothing stored yet. tasks from before schema versions are version
+		//1, and an empty database starts out current
+		cols, err := m.taskCollections()
+		if err != nil {
+			return
+		}
+		for _, c := range cols {
+			var n int
+			if n, err = c.Count(); err != nil {
+				return
+			}
+			if n > 0 {
+				version = 1
+				return
+			}
+		}
+		version = currentSchema()
+		_, err = m.meta().UpsertId("schema", d{"version": version})
+		return
+	})
 	return
 }
+
+func (m *mongoBackend) migrate(ctx context.Context, mig migration) (err error) {
+	err = m.do(ctx, "", func() (err error) {
+		cols, err := m.taskCollections()
+		if err != nil {
+			return
+		}
+		for _, c := range cols {
+			iter := c.Find(nil).Iter()
+			for {
+				raw := bson.M{}
+				if !iter.Next(&raw) {
+					break
+				}
+				t := doc(plainDoc(raw).(map[string]interface{}))
+				if err = mig.task(t); err == nil {
+					err = c.UpdateId(t["_id"], t)
+				}
+				if err != nil {
+					iter.Close()
+					return
+				}
+			}
+			if err = iter.Close(); err != nil {
+				return
+			}
+		}
+		_, err = m.meta().UpsertId("schema", d{"version": mig.version})
+		return
+	})
+	return
+}
+
+// plainDoc turns the bson.M documents mgo decodes into plain maps, so
+// migrations see the same types from every backend.
+func plainDoc(v interface{}) interface{} {
+	switch x := v.(type) {
+	case bson.M:
+		return plainDoc(map[string]interface{}(x))
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = plainDoc(e)
+		}
+		return x
+	case []interface{}:
+		for i, e := range x {
+			x[i] = plainDoc(e)
+		}
+	}
+	return v
+}
@@ -15,6 +15,8 @@ func init() {
 
 		flags: flag.NewFlagSet("mv", flag.ExitOnError),
 		run:   mv,
+
+		complete: taskArgs(1),
 	}
 
 	commands["mv"] = cmd
@@ -25,14 +27,14 @@ func mv(c *command) {
 	if len(args) != 2 {
 		c.Usage(1)
 	}
-	task, err := defaultBackend.Load(args[0])
+	task, err := loadTaskStrictly(c.ctx, args[0])
 	if err != nil {
 		c.Error(err)
 	}
 
-	if err := defaultBackend.Rename(task.Name, args[1]); err != nil {
+	if err := defaultBackend.Rename(c.ctx, task.Name, args[1]); err != nil {
 		c.Error(err)
 	}
 
-	fmt.Printf("moved %s to %s\n", args[0], args[1])
+	fmt.Printf("moved %s to %s\n", task.Name, args[1])
 }
@@ -28,7 +28,7 @@ func newTask(c *command) {
 	task := Task{
 		Name: args[0],
 	}
-	if err := defaultBackend.Save(&task); err != nil {
+	if err := defaultBackend.Save(c.ctx, &task); err != nil {
 		c.Error(err)
 	}
 	fmt.Println("created task:", task.Name)
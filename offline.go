@@ -0,0 +1,864 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// OfflineConfig turns on offline mode for a remote backend. reads are kept in
+// a local replica, and changes made while the backend is unreachable are
+// queued there until est sync replays them.
+type OfflineConfig struct {
+	Path string `json:",omitempty"` //file for the replica and queue. default $HOME/.est-offline
+}
+
+func (c *OfflineConfig) path() string {
+	if c.Path != "" {
+		return c.Path
+	}
+	return os.ExpandEnv("$HOME/.est-offline")
+}
+
+// openOffline wraps the remote backend, or works from the replica alone if
+// the remote backend was unavailable.
+func openOffline(c *OfflineConfig, remote Backend, remoteErr error) (b Backend, err error) {
+	if remoteErr != nil && !isCode(remoteErr, ErrUnavailable) {
+		err = remoteErr
+		return
+	}
+
+	o := &offlineBackend{
+		remote: remote,
+		path:   c.path(),
+	}
+	if err = o.load(); err != nil {
+		return
+	}
+	if remoteErr != nil {
+		o.remote = nil
+		o.warn(remoteErr)
+	}
+	b = o
+	return
+}
+
+// offlineBackend keeps the replica it last read in state. other ests share
+// the file, so every call reads it again, and changes are made holding its
+// lock.
+type offlineBackend struct {
+	remote Backend //nil while unreachable
+	path   string
+	state  offlineState
+	warned bool
+}
+
+type offlineState struct {
+	Schema int
+	Tasks  map[string]*Task
+	Timer  *StartLog   `json:",omitempty"`
+	Queue  []offlineOp `json:",omitempty"`
+}
+
+// offlineOp is a change queued while offline. Base is the state of the task
+// before the change, which sync compares with the remote backend to detect
+// conflicting changes made by someone else.
+type offlineOp struct {
+	Op   string
+	Name string
+	When time.Time
+
+	Task       *Task        `json:",omitempty"`
+	Desc       string       `json:",omitempty"`
+	Annotation *Annotation  `json:",omitempty"`
+	NewName    string       `json:",omitempty"`
+	Base       *offlineBase `json:",omitempty"`
+}
+
+type offlineBase struct {
+	Exists      bool
+	Description string      `json:",omitempty"`
+	Annotations int         `json:",omitempty"`
+	Last        *Annotation `json:",omitempty"`
+}
+
+func (op offlineOp) String() string {
+	when := op.When.Local().Format(timeFormat)
+	switch op.Op {
+	case "save":
+		return fmt.Sprintf("%s: create %s", when, op.Name)
+	case "describe":
+		return fmt.Sprintf("%s: set description of %s", when, op.Name)
+	case "annotate":
+		return fmt.Sprintf("%s: add %s to %s", when, op.Annotation.DeltaString(), op.Name)
+	case "pop":
+		return fmt.Sprintf("%s: undo last annotation of %s", when, op.Name)
+	case "rename":
+		return fmt.Sprintf("%s: rename %s to %s", when, op.Name, op.NewName)
+	case "remove":
+		return fmt.Sprintf("%s: remove %s", when, op.Name)
+	case "start":
+		return fmt.Sprintf("%s: start %s", when, op.Name)
+	case "stop":
+		return fmt.Sprintf("%s: stop timer", when)
+	case "stoptimer":
+		return fmt.Sprintf("%s: stop timer adding %s to %s", when, op.Annotation.DeltaString(), op.Name)
+	}
+	return fmt.Sprintf("%s: %s %s", when, op.Op, op.Name)
+}
+
+//
+// the replica file
+//
+
+// load reads the replica as other ests left it. the file is only ever
+// replaced whole, so it can be read without the lock.
+func (o *offlineBackend) load() (err error) {
+	state := offlineState{
+		Schema: currentSchema(),
+		Tasks:  map[string]*Task{},
+	}
+	data, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		o.state, err = state, nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if data, err = migrateReplica(data); err != nil {
+		err = fmt.Errorf("error migrating offline replica %s: %s", o.path, err)
+		return
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		err = fmt.Errorf("error parsing offline replica %s: %s", o.path, err)
+		return
+	}
+	if state.Tasks == nil {
+		state.Tasks = map[string]*Task{}
+	}
+	o.state = state
+	return
+}
+
+// update reads the replica holding its lock, so no change another est makes
+// in the meantime is written over, and saves it if fn changed it without
+// error.
+func (o *offlineBackend) update(fn func() error) (err error) {
+	unlock, err := lockFile(o.path+".lock", defaultLockTimeout)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = o.load(); err != nil {
+		return
+	}
+	if err = fn(); err != nil {
+		return
+	}
+	return o.save()
+}
+
+// migrateReplica brings the tasks in a replica written by an older est up to
+// the current schema. replicas from before schema versions have none stored.
+func migrateReplica(data []byte) (out []byte, err error) {
+	var state map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&state); err != nil {
+		return
+	}
+
+	version := int(docInt(doc(state).get("schema")))
+	if version == 0 {
+		version = 1
+	}
+	if version > currentSchema() {
+		err = errorf(ErrInvalidArgument, "replica is at schema version %d but this est only knows up to %d. upgrade est", version, currentSchema())
+		return
+	}
+	if version == currentSchema() {
+		out = data
+		return
+	}
+
+	//tasks are in the replica and in queued saves
+	var tasks []doc
+	if m, ok := doc(state).get("tasks").(map[string]interface{}); ok {
+		for _, t := range m {
+			if t, ok := t.(map[string]interface{}); ok {
+				tasks = append(tasks, t)
+			}
+		}
+	}
+	for _, op := range doc(state).list("queue") {
+		if t, ok := op.get("task").(map[string]interface{}); ok {
+			tasks = append(tasks, t)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		for _, t := range tasks {
+			if err = m.task(t); err != nil {
+				return
+			}
+		}
+	}
+	doc(state).set("schema", currentSchema())
+	out, err = json.Marshal(state)
+	return
+}
+
+// save writes the replica to a temporary file and moves it into place so a
+// crash can't leave it half written. callers hold the lock, through update.
+func (o *offlineBackend) save() (err error) {
+	data, err := json.Marshal(o.state)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), ".est-offline")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), o.path)
+	return
+}
+
+//
+// choosing between the remote backend and the replica
+//
+
+// online reports if calls should go to the remote backend. once a change is
+// queued everything goes to the replica until sync, so changes stay in order
+// and reads see them.
+func (o *offlineBackend) online() bool {
+	return o.remote != nil && len(o.state.Queue) == 0
+}
+
+func (o *offlineBackend) warn(err error) {
+	if o.warned {
+		return
+	}
+	o.warned = true
+	fmt.Fprintf(os.Stderr, "warning: working offline (%s)\n", err)
+	fmt.Fprintln(os.Stderr, "changes are queued until you run 'est sync'")
+}
+
+// fallback reports if the call should be served by the replica after the
+// remote backend returned err.
+func (o *offlineBackend) fallback(err error) bool {
+	if !isCode(err, ErrUnavailable) {
+		return false
+	}
+	o.remote = nil
+	o.warn(err)
+	return true
+}
+
+func copyTask(t *Task) *Task {
+	c := *t
+	c.Annotations = append([]Annotation(nil), t.Annotations...)
+	return &c
+}
+
+func (o *offlineBackend) base(name string) *offlineBase {
+	t, ok := o.state.Tasks[name]
+	if !ok {
+		return &offlineBase{}
+	}
+	b := &offlineBase{
+		Exists:      true,
+		Description: t.Description,
+		Annotations: len(t.Annotations),
+	}
+	if n := len(t.Annotations); n > 0 {
+		last := t.Annotations[n-1]
+		b.Last = &last
+	}
+	return b
+}
+
+// mutate makes a change on the remote backend and then the replica while
+// online. otherwise it only changes the replica and queues the change, and
+// local is told so. local may fill in op before it's queued.
+func (o *offlineBackend) mutate(ctx context.Context, op *offlineOp, remote func(Backend) error, local func(queued bool) error) (err error) {
+	if err = o.load(); err != nil {
+		return
+	}
+	if o.online() {
+		err = remote(o.remote)
+		if !o.fallback(err) {
+			if err == nil {
+				var lerr error
+				err = o.update(func() error {
+					lerr = local(false)
+					return lerr
+				})
+				if err == lerr {
+					//the replica may not have the task yet
+					err = nil
+				}
+			}
+			return
+		}
+	}
+
+	err = o.update(func() (err error) {
+		op.When = time.Now()
+		op.Base = o.base(op.Name)
+		if err = local(true); err != nil {
+			return
+		}
+		o.state.Queue = append(o.state.Queue, *op)
+		return
+	})
+	return
+}
+
+func (o *offlineBackend) localTask(name string) (t *Task, err error) {
+	t, ok := o.state.Tasks[name]
+	if !ok {
+		err = errorf(ErrNotFound, "task %q not found", name)
+	}
+	return
+}
+
+// revise returns the replica's copy of the task. a queued change is checked
+// against the revision of the task like the backends do, while online the
+// remote backend has done that and moved task to the next revision already.
+func (o *offlineBackend) revise(task *Task, queued bool) (t *Task, err error) {
+	if t, err = o.localTask(task.Name); err != nil {
+		return
+	}
+	if queued {
+		if t.Revision != task.Revision {
+			err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+			return
+		}
+		task.Revision++
+	}
+	t.Revision = task.Revision
+	return
+}
+
+//
+// Backend
+//
+
+func (o *offlineBackend) Save(ctx context.Context, task *Task) (err error) {
+	op := offlineOp{Op: "save", Name: task.Name}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.Save(ctx, task)
+	}, func(queued bool) error {
+		//pick a free name the same way the backends do
+		if queued {
+			candidate := task.Name
+			for i := 1; o.state.Tasks[candidate] != nil; i++ {
+				candidate = fmt.Sprintf("%s%d", task.Name, i)
+			}
+			task.Name = candidate
+			op.Name, op.Task = candidate, copyTask(task)
+		}
+		o.state.Tasks[task.Name] = copyTask(task)
+		return nil
+	})
+	return
+}
+
+func (o *offlineBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	op := offlineOp{Op: "describe", Name: task.Name, Desc: desc}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.SetDescription(ctx, task, desc)
+	}, func(queued bool) error {
+		t, err := o.revise(task, queued)
+		if err == nil {
+			t.Description = desc
+		}
+		return err
+	})
+	return
+}
+
+func (o *offlineBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	op := offlineOp{Op: "annotate", Name: task.Name, Annotation: &a}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.AddAnnotation(ctx, task, a)
+	}, func(queued bool) error {
+		t, err := o.revise(task, queued)
+		if err == nil {
+			t.Apply(a)
+		}
+		return err
+	})
+	return
+}
+
+func (o *offlineBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	if len(task.Annotations) == 0 {
+		err = errorf(ErrInvalidArgument, "no annotations to undo")
+		return
+	}
+	op := offlineOp{Op: "pop", Name: task.Name}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.PopAnnotation(ctx, task)
+	}, func(queued bool) error {
+		t, err := o.revise(task, queued)
+		if err != nil {
+			return err
+		}
+		if len(t.Annotations) == 0 {
+			return errorf(ErrInvalidArgument, "no annotations to undo")
+		}
+		last := t.Annotations[len(t.Annotations)-1]
+		t.Annotations = t.Annotations[:len(t.Annotations)-1]
+		t.Estimate -= last.EstimateDelta
+		t.Actual -= last.ActualDelta
+		return nil
+	})
+	return
+}
+
+func (o *offlineBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	if err = o.load(); err != nil {
+		return
+	}
+	if o.online() {
+		task, err = o.remote.Load(ctx, name)
+		if !o.fallback(err) {
+			switch {
+			case err == nil:
+				o.update(func() error {
+					o.state.Tasks[name] = copyTask(task)
+					return nil
+				})
+			case isCode(err, ErrNotFound):
+				o.update(func() error {
+					delete(o.state.Tasks, name)
+					return nil
+				})
+			}
+			return
+		}
+	}
+
+	t, err := o.localTask(name)
+	if err != nil {
+		return
+	}
+	task = copyTask(t)
+	return
+}
+
+func (o *offlineBackend) Start(ctx context.Context, name string) (err error) {
+	op := offlineOp{Op: "start", Name: name}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.Start(ctx, name)
+	}, func(bool) error {
+		o.state.Timer = &StartLog{
+			Name: name,
+			When: time.Now(),
+		}
+		return nil
+	})
+	return
+}
+
+func (o *offlineBackend) Stop(ctx context.Context) (err error) {
+	op := offlineOp{Op: "stop"}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.Stop(ctx)
+	}, func(bool) error {
+		o.state.Timer = nil
+		return nil
+	})
+	return
+}
+
+func (o *offlineBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	if err = o.load(); err != nil {
+		return
+	}
+	if o.online() {
+		log, task, err = o.remote.StopTimer(ctx, when)
+		if !o.fallback(err) {
+			if err == nil {
+				err = o.update(func() error {
+					o.state.Timer = nil
+					if task != nil {
+						o.state.Tasks[task.Name] = copyTask(task)
+					}
+					return nil
+				})
+			}
+			return
+		}
+	}
+
+	err = o.update(func() error {
+		if o.state.Timer == nil {
+			return nil
+		}
+		l := *o.state.Timer
+		log = &l
+		ann := log.Annotation(when)
+		op := offlineOp{
+			Op:         "stoptimer",
+			Name:       log.Name,
+			When:       when,
+			Annotation: &ann,
+			Base:       o.base(log.Name),
+		}
+
+		o.state.Timer = nil
+		if t, ok := o.state.Tasks[log.Name]; ok {
+			t.Apply(ann)
+			t.Revision++
+			task = copyTask(t)
+		} else {
+			task = &Task{Name: log.Name}
+			task.Apply(ann)
+		}
+		o.state.Queue = append(o.state.Queue, op)
+		return nil
+	})
+	if err != nil {
+		log, task = nil, nil
+	}
+	return
+}
+
+func (o *offlineBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	if err = o.load(); err != nil {
+		return
+	}
+	if o.online() {
+		log, err = o.remote.Status(ctx)
+		if !o.fallback(err) {
+			if err == nil {
+				o.update(func() error {
+					o.state.Timer = log
+					return nil
+				})
+			}
+			return
+		}
+	}
+
+	if o.state.Timer != nil {
+		l := *o.state.Timer
+		log = &l
+	}
+	return
+}
+
+func (o *offlineBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	if err = o.load(); err != nil {
+		return
+	}
+	if o.online() {
+		tasks, err = o.remote.Find(ctx, regex, before, after)
+		if !o.fallback(err) {
+			if err == nil {
+				o.update(func() error {
+					for _, t := range tasks {
+						o.state.Tasks[t.Name] = copyTask(t)
+					}
+					return nil
+				})
+			}
+			return
+		}
+	}
+
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "invalid regex: %s", err)
+		return
+	}
+	for _, t := range o.state.Tasks {
+		if re.MatchString(t.Name) && annotatedIn(t, before, after) {
+			tasks = append(tasks, copyTask(t))
+		}
+	}
+	return
+}
+
+func (o *offlineBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	op := offlineOp{Op: "rename", Name: oldn, NewName: newn}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.Rename(ctx, oldn, newn)
+	}, func(bool) error {
+		t, ok := o.state.Tasks[oldn]
+		if !ok {
+			//the replica may not have it yet when online
+			return nil
+		}
+		if _, ok := o.state.Tasks[newn]; ok {
+			return errorf(ErrConflict, "task %q already exists", newn)
+		}
+		delete(o.state.Tasks, oldn)
+		t.Name = newn
+		o.state.Tasks[newn] = t
+		if o.state.Timer != nil && o.state.Timer.Name == oldn {
+			o.state.Timer.Name = newn
+		}
+		return nil
+	})
+	return
+}
+
+func (o *offlineBackend) Remove(ctx context.Context, name string) (err error) {
+	op := offlineOp{Op: "remove", Name: name}
+	err = o.mutate(ctx, &op, func(b Backend) error {
+		return b.Remove(ctx, name)
+	}, func(bool) error {
+		delete(o.state.Tasks, name)
+		return nil
+	})
+	return
+}
+
+//
+// sync
+//
+
+// sameAnnotation compares annotations to the millisecond, which is all some
+// backends store.
+func sameAnnotation(a, b Annotation) bool {
+	return a.When.Truncate(time.Millisecond).Equal(b.When.Truncate(time.Millisecond)) &&
+		a.EstimateDelta == b.EstimateDelta &&
+		a.ActualDelta == b.ActualDelta &&
+		a.Focus == b.Focus
+}
+
+// conflict checks the remote state of the task against the state the queued
+// change was made on. it returns a description of the conflict, if any.
+func (o *offlineBackend) conflict(ctx context.Context, op offlineOp) (reason string, err error) {
+	if op.Op == "start" || op.Op == "stop" {
+		return
+	}
+
+	remote, err := o.remote.Load(ctx, op.Name)
+	if isCode(err, ErrNotFound) {
+		remote, err = nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	switch {
+	case op.Op == "save":
+		if remote != nil {
+			reason = "a task with that name was created elsewhere"
+		}
+		return
+	case op.Op == "remove" && remote == nil:
+		return
+	case remote == nil:
+		reason = "the task was removed or renamed elsewhere"
+		return
+	case op.Op == "annotate", op.Op == "stoptimer":
+		//annotations add up in any order
+		return
+	case op.Op == "rename":
+		if _, err = o.remote.Load(ctx, op.NewName); err == nil {
+			reason = fmt.Sprintf("a task named %s was created elsewhere", op.NewName)
+			return
+		}
+		if !isCode(err, ErrNotFound) {
+			return
+		}
+		err = nil
+	}
+
+	base := op.Base
+	switch {
+	case base == nil:
+	case op.Op == "describe" && remote.Description != base.Description:
+		reason = "the description was changed elsewhere"
+	case len(remote.Annotations) != base.Annotations:
+		reason = "annotations were changed elsewhere"
+	case base.Last != nil && !sameAnnotation(remote.Annotations[len(remote.Annotations)-1], *base.Last):
+		reason = "annotations were changed elsewhere"
+	}
+	return
+}
+
+// replay applies a queued change to the remote backend. conflict has
+// already compared the task with the queued change, so changes are made on
+// the remote task's current revision.
+func (o *offlineBackend) replay(ctx context.Context, op offlineOp, timerRunning bool) (err error) {
+	r := o.remote
+	annotate := func(a Annotation) (err error) {
+		var task *Task
+		if task, err = r.Load(ctx, op.Name); err == nil {
+			err = r.AddAnnotation(ctx, task, a)
+		}
+		return
+	}
+
+	switch op.Op {
+	case "save":
+		err = r.Save(ctx, copyTask(op.Task))
+	case "describe":
+		var task *Task
+		if task, err = r.Load(ctx, op.Name); err == nil {
+			err = r.SetDescription(ctx, task, op.Desc)
+		}
+	case "annotate":
+		err = annotate(*op.Annotation)
+	case "pop":
+		var task *Task
+		if task, err = r.Load(ctx, op.Name); err == nil {
+			err = r.PopAnnotation(ctx, task)
+		}
+	case "rename":
+		err = r.Rename(ctx, op.Name, op.NewName)
+	case "remove":
+		err = r.Remove(ctx, op.Name)
+	case "stop":
+		err = r.Stop(ctx)
+	case "stoptimer":
+		//the time was worked out offline, and the remote timer may have been
+		//started by an earlier replay, so don't let the backend work it out
+		if err = r.Stop(ctx); err == nil {
+			err = annotate(*op.Annotation)
+		}
+	case "start":
+		if err = r.Start(ctx, op.Name); err != nil || !timerRunning {
+			return
+		}
+
+		//the remote timer starts now, so record the time spent since the
+		//timer started offline
+		err = annotate(StartLog{When: op.When}.Annotation(time.Now()))
+	default:
+		err = fmt.Errorf("unknown queued change: %q", op.Op)
+	}
+	return
+}
+
+// sync replays the queue against the remote backend in order. it stops at the
+// first conflict unless force applies conflicting changes anyway or skip
+// drops them.
+func (o *offlineBackend) sync(ctx context.Context, force, skip bool, report func(op offlineOp, result string)) (err error) {
+	if o.remote == nil {
+		err = errorf(ErrUnavailable, "backend is unreachable")
+		return
+	}
+
+	//one sync at a time, so no change is replayed twice. the replica isn't
+	//locked while replaying, so other ests can keep queueing changes.
+	unlock, err := lockFile(o.path+".sync", defaultLockTimeout)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	if err = o.load(); err != nil {
+		return
+	}
+
+	touched := map[string]bool{}
+	for len(o.state.Queue) > 0 {
+		op := o.state.Queue[0]
+		touched[op.Name], touched[op.NewName] = true, true
+
+		var reason string
+		if reason, err = o.conflict(ctx, op); err != nil {
+			return
+		}
+		switch {
+		case reason != "" && skip:
+			report(op, "skipped: "+reason)
+			if err = o.dropFirst(); err != nil {
+				return
+			}
+			continue
+		case reason != "" && !force:
+			err = errorf(ErrConflict, "%s: %s", op, reason)
+			return
+		}
+
+		//a start is still running if no timer change comes after it
+		running := op.Op == "start"
+		for _, later := range o.state.Queue[1:] {
+			if later.Op == "start" || later.Op == "stop" || later.Op == "stoptimer" {
+				running = false
+			}
+		}
+
+		if err = o.replay(ctx, op, running); err != nil {
+			return
+		}
+		if reason != "" {
+			report(op, "forced: "+reason)
+		} else {
+			report(op, "applied")
+		}
+		if err = o.dropFirst(); err != nil {
+			return
+		}
+	}
+
+	//refresh the replica now that the remote backend is authoritative again
+	delete(touched, "")
+	tasks := map[string]*Task{} //nil for the tasks that are gone
+	for name := range touched {
+		var task *Task
+		task, err = o.remote.Load(ctx, name)
+		switch {
+		case err == nil:
+			tasks[name] = task
+		case isCode(err, ErrNotFound):
+			tasks[name], err = nil, nil
+		default:
+			return
+		}
+	}
+	timer, err := o.remote.Status(ctx)
+	if err != nil {
+		return
+	}
+	err = o.update(func() error {
+		if len(o.state.Queue) > 0 {
+			//changes queued since the loop ended are ahead of the remote
+			return nil
+		}
+		for name, task := range tasks {
+			if task == nil {
+				delete(o.state.Tasks, name)
+			} else {
+				o.state.Tasks[name] = task
+			}
+		}
+		o.state.Timer = timer
+		return nil
+	})
+	return
+}
+
+// dropFirst takes the change sync is done with off the queue. other ests only
+// add to the end of it, so it's still first.
+func (o *offlineBackend) dropFirst() error {
+	return o.update(func() error {
+		o.state.Queue = o.state.Queue[1:]
+		return nil
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestOfflineSharedReplica(t *testing.T) {
+	dir := t.TempDir()
+	conf := &OfflineConfig{Path: filepath.Join(dir, "replica")}
+	down := errorf(ErrUnavailable, "down")
+	ctx := context.Background()
+
+	//a long running est and another queueing changes next to it
+	long, err := openOffline(conf, nil, down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openOffline(conf, nil, down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(ctx, &Task{Name: "theirs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := long.Save(ctx, &Task{Name: "mine"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := long.Load(ctx, "theirs"); err != nil {
+		t.Fatalf("the long running est doesn't see the other's task: %v", err)
+	}
+
+	remote, err := openBolt(&BoltConfig{Path: filepath.Join(dir, "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openOffline(conf, remote, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := b.(*offlineBackend)
+	if len(o.state.Queue) != 2 {
+		t.Fatalf("queued %v", o.state.Queue)
+	}
+	if err := o.sync(ctx, false, false, func(offlineOp, string) {}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"theirs", "mine"} {
+		if _, err := remote.Load(ctx, name); err != nil {
+			t.Errorf("%s wasn't synced: %v", name, err)
+		}
+	}
+}
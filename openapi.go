@@ -0,0 +1,229 @@
+package main
+
+// openAPISpec describes the rest api served under /api. durations in tasks
+// and annotations are nanoseconds. durations sent in request bodies may be
+// either nanoseconds or a string like "1h30m".
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "est",
+    "description": "A json api for managing estimates.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api"}],
+  "security": [{"token": []}],
+  "paths": {
+    "/users": {
+      "get": {
+        "summary": "List the users of the server (admins only)",
+        "responses": {
+          "200": {"description": "the users", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/User"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks": {
+      "get": {
+        "summary": "Find tasks with annotations in a time window",
+        "parameters": [
+          {"name": "regex", "in": "query", "schema": {"type": "string"}, "description": "regular expression the task name must match"},
+          {"name": "before", "in": "query", "schema": {"type": "string", "format": "date-time"}, "description": "earliest annotation time (inclusive)"},
+          {"name": "after", "in": "query", "schema": {"type": "string", "format": "date-time"}, "description": "latest annotation time (exclusive), defaults to now"}
+        ],
+        "responses": {
+          "200": {"description": "matching tasks", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Task"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a task",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewTask"}}}},
+        "responses": {
+          "201": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Load a task",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a task",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks/{name}/description": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "put": {
+        "summary": "Set the description of a task",
+        "parameters": [{"$ref": "#/components/parameters/IfMatch"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "properties": {"description": {"type": "string"}}}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks/{name}/rename": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Rename a task",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks/{name}/annotations": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Add estimate or actual time to a task",
+        "parameters": [{"$ref": "#/components/parameters/IfMatch"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewAnnotation"}}}},
+        "responses": {
+          "201": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/tasks/{name}/annotations/last": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "delete": {
+        "summary": "Remove the last annotation from a task",
+        "parameters": [{"$ref": "#/components/parameters/IfMatch"}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Task"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/timer": {
+      "get": {
+        "summary": "Show the running timer",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Timer"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Start working on a task, recording time on any running timer first",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}}}},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Timer"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Stop the running timer and record the time spent",
+        "responses": {
+          "200": {"description": "the stopped timer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stopped"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer", "description": "api token, required when the server has a users file. admins may send X-Est-User to act on the data of another user."}
+    },
+    "parameters": {
+      "Name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "IfMatch": {"name": "If-Match", "in": "header", "schema": {"type": "integer", "format": "int64"}, "description": "revision the task must still be at, otherwise the change fails with a conflict"}
+    },
+    "responses": {
+      "Task": {"description": "a task", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Task"}}}},
+      "Timer": {"description": "the timer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Timer"}}}},
+      "Error": {"description": "an error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Duration": {"type": "integer", "format": "int64", "description": "nanoseconds"},
+      "DurationInput": {"oneOf": [{"type": "integer", "format": "int64"}, {"type": "string", "example": "1h30m"}]},
+      "Annotation": {
+        "type": "object",
+        "properties": {
+          "When": {"type": "string", "format": "date-time"},
+          "EstimateDelta": {"$ref": "#/components/schemas/Duration"},
+          "ActualDelta": {"$ref": "#/components/schemas/Duration"},
+          "Focus": {"type": "boolean", "description": "the time is a completed focus session"}
+        }
+      },
+      "Task": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Description": {"type": "string"},
+          "Revision": {"type": "integer", "format": "int64", "description": "counts changes to the task. send it back in If-Match to only change the task if nobody else has"},
+          "Estimate": {"$ref": "#/components/schemas/Duration"},
+          "Actual": {"$ref": "#/components/schemas/Duration"},
+          "Annotations": {"type": "array", "items": {"$ref": "#/components/schemas/Annotation"}}
+        }
+      },
+      "StartLog": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "When": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Timer": {
+        "type": "object",
+        "properties": {
+          "Running": {"type": "boolean"},
+          "Log": {"$ref": "#/components/schemas/StartLog"},
+          "Task": {"$ref": "#/components/schemas/Task"}
+        }
+      },
+      "Stopped": {
+        "type": "object",
+        "properties": {
+          "Log": {"$ref": "#/components/schemas/StartLog"},
+          "Annotation": {"$ref": "#/components/schemas/Annotation"},
+          "Task": {"$ref": "#/components/schemas/Task"}
+        }
+      },
+      "NewTask": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "description": {"type": "string"},
+          "estimate": {"$ref": "#/components/schemas/DurationInput"}
+        }
+      },
+      "NewAnnotation": {
+        "type": "object",
+        "properties": {
+          "when": {"type": "string", "format": "date-time", "description": "defaults to now"},
+          "estimateDelta": {"$ref": "#/components/schemas/DurationInput"},
+          "actualDelta": {"$ref": "#/components/schemas/DurationInput"},
+          "focus": {"type": "boolean"}
+        }
+      },
+      "User": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Admin": {"type": "boolean"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"type": "string", "enum": ["not-found", "conflict", "invalid-argument", "unavailable", "unauthorized"], "description": "absent for internal errors"}
+        }
+      }
+    }
+  }
+}
+`
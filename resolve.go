@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loadTask loads the task named on the command line. besides the exact
+// name it takes "-" for the running task, or else the last one touched,
+// and a prefix or fuzzy match of a single task's name. when nothing
+// matches the error suggests names that are close.
+func loadTask(ctx context.Context, name string) (task *Task, err error) {
+	return resolveTask(ctx, name, true)
+}
+
+// loadTaskStrictly is loadTask for commands that remove or rewrite what was
+// recorded. a fuzzy match is too easily the wrong task, so it's only
+// suggested.
+func loadTaskStrictly(ctx context.Context, name string) (task *Task, err error) {
+	return resolveTask(ctx, name, false)
+}
+
+func resolveTask(ctx context.Context, name string, fuzzy bool) (task *Task, err error) {
+	if name == "-" {
+		return lastTask(ctx)
+	}
+
+	task, err = defaultBackend.Load(ctx, name)
+	if !isCode(err, ErrNotFound) {
+		return
+	}
+	notFound := err
+
+	tasks, err := allTasks(ctx, defaultBackend)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, t := range tasks {
+		names = append(names, t.Name)
+	}
+	sort.Strings(names)
+
+	matching := func(match func(string) bool) (found []string) {
+		for _, n := range names {
+			if match(n) {
+				found = append(found, n)
+			}
+		}
+		return
+	}
+	prefixed := matching(func(n string) bool { return strings.HasPrefix(n, name) })
+	similar := matching(func(n string) bool { return fuzzyMatch(name, n) })
+
+	for _, found := range [][]string{prefixed, similar} {
+		switch {
+		case len(found) == 1:
+			return defaultBackend.Load(ctx, found[0])
+		case len(found) > 1:
+			err = errorf(ErrInvalidArgument, "%q matches several tasks: %s", name, strings.Join(found, ", "))
+			return
+		}
+		if !fuzzy {
+			break
+		}
+	}
+
+	err = notFound
+	near := closeNames(name, names)
+	if !fuzzy {
+		near = append(similar, near...)
+	}
+	if near = unique(near); len(near) > 5 {
+		near = near[:5]
+	}
+	if len(near) > 0 {
+		err = errorf(ErrNotFound, "task %q not found. did you mean %s?", name, strings.Join(near, ", "))
+	}
+	return
+}
+
+// unique drops repeated strings, keeping the first of each.
+func unique(s []string) (u []string) {
+	seen := map[string]bool{}
+	for _, x := range s {
+		if !seen[x] {
+			seen[x] = true
+			u = append(u, x)
+		}
+	}
+	return
+}
+
+// lastTask is the running task, or the task with the latest annotation.
+func lastTask(ctx context.Context) (task *Task, err error) {
+	log, err := defaultBackend.Status(ctx)
+	if err != nil {
+		return
+	}
+	if log != nil {
+		return defaultBackend.Load(ctx, log.Name)
+	}
+
+	tasks, err := defaultBackend.Find(ctx, "", time.Time{}, time.Now().AddDate(100, 0, 0))
+	if err != nil {
+		return
+	}
+	if len(tasks) == 0 {
+		err = errorf(ErrNotFound, "no task is running or was worked on")
+		return
+	}
+	sort.Sort(sortedTasks(tasks))
+	return tasks[0], nil
+}
+
+// fuzzyMatch tells if the letters of the pattern appear in order in the
+// name, ignoring case.
+func fuzzyMatch(pattern, name string) bool {
+	name = strings.ToLower(name)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(name, r)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(string(r)):]
+	}
+	return true
+}
+
+// closeNames lists up to five names within a few edits of the name,
+// closest first.
+func closeNames(name string, names []string) (near []string) {
+	limit := len(name)/3 + 1
+	dist := map[string]int{}
+	for _, n := range names {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(n)); d <= limit {
+			dist[n] = d
+			near = append(near, n)
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool { return dist[near[i]] < dist[near[j]] })
+	if len(near) > 5 {
+		near = near[:5]
+	}
+	return
+}
+
+// editDistance counts the insertions, deletions and substitutions turning a
+// into b.
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
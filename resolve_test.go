@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testResolveBackend(t *testing.T, names ...string) {
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(t.TempDir(), "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultBackend = b
+	for _, name := range names {
+		if err := b.Save(context.Background(), &Task{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadTask(t *testing.T) {
+	testResolveBackend(t, "zzz-thing", "frontend", "backend")
+	ctx := context.Background()
+
+	for arg, want := range map[string]string{
+		"zzz-thing": "zzz-thing",
+		"zzz":       "zzz-thing",
+		"fr":        "frontend",
+		"fe":        "frontend",
+	} {
+		task, err := loadTask(ctx, arg)
+		if err != nil || task.Name != want {
+			t.Errorf("%q loaded %v %v, want %s", arg, task, err, want)
+		}
+	}
+
+	if _, err := loadTask(ctx, "end"); !isCode(err, ErrInvalidArgument) {
+		t.Errorf("an ambiguous name: %v", err)
+	}
+	if _, err := loadTask(ctx, "frontedn"); !isCode(err, ErrNotFound) || !strings.Contains(err.Error(), "did you mean frontend") {
+		t.Errorf("a misspelt name: %v", err)
+	}
+}
+
+func TestLoadTaskStrictly(t *testing.T) {
+	testResolveBackend(t, "frontend", "backend")
+	ctx := context.Background()
+
+	if task, err := loadTaskStrictly(ctx, "fro"); err != nil || task.Name != "frontend" {
+		t.Errorf("a unique prefix loaded %v %v", task, err)
+	}
+	_, err := loadTaskStrictly(ctx, "fe")
+	if !isCode(err, ErrNotFound) || !strings.Contains(err.Error(), "did you mean frontend") {
+		t.Errorf("a fuzzy match wasn't only suggested: %v", err)
+	}
+}
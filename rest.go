@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// rest api: a json view of the backend served next to the rpc endpoint
+//
+
+func init() {
+	http.Handle("/api/", http.StripPrefix("/api", restHandler{}))
+}
+
+type restHandler struct{}
+
+// restError is the body sent back for any failed request. Code is empty for
+// internal errors.
+type restError struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code,omitempty"`
+}
+
+// restDuration accepts either a duration string like "1h30m" or a number of
+// nanoseconds, which is how durations are encoded in tasks.
+type restDuration time.Duration
+
+func (r *restDuration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err = json.Unmarshal(b, &n); err != nil {
+			return
+		}
+		*r = restDuration(n)
+		return
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return
+	}
+	*r = restDuration(d)
+	return
+}
+
+type restNewTask struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Estimate    restDuration `json:"estimate"`
+}
+
+type restDescription struct {
+	Description string `json:"description"`
+}
+
+type restRename struct {
+	Name string `json:"name"`
+}
+
+type restAnnotation struct {
+	When          time.Time    `json:"when"`
+	EstimateDelta restDuration `json:"estimateDelta"`
+	ActualDelta   restDuration `json:"actualDelta"`
+	Focus         bool         `json:"focus"`
+}
+
+type restStart struct {
+	Name string `json:"name"`
+}
+
+type restTimer struct {
+	Running bool
+	Log     *StartLog `json:",omitempty"`
+	Task    *Task     `json:",omitempty"`
+}
+
+type restUser struct {
+	Name  string
+	Admin bool
+}
+
+type restStopped struct {
+	Log        *StartLog
+	Annotation Annotation
+	Task       *Task
+}
+
+// restWriter remembers the status and error of a response for the log
+type restWriter struct {
+	http.ResponseWriter
+	code int
+	err  error
+}
+
+func (w *restWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (h restHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w := &restWriter{ResponseWriter: rw, code: http.StatusOK}
+	var user string
+	defer func(start time.Time) {
+		attrs := []interface{}{
+			"method", req.Method,
+			"path", req.URL.Path,
+			"user", user,
+			"remote", req.RemoteAddr,
+			"status", w.code,
+			"latency", time.Since(start),
+		}
+		if w.err != nil {
+			serveLog.Warn("api", append(attrs, "error", w.err.Error())...)
+		} else {
+			serveLog.Info("api", attrs...)
+		}
+	}(time.Now())
+
+	ctx, cancel := callContext(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	route := req.Method + " " + parts[0]
+
+	//the description is public so clients can discover how to authenticate
+	if len(parts) == 1 && route == "GET openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPISpec)
+		return
+	}
+
+	b, user, err := requestBackend(req)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && route == "GET users":
+		h.users(w, req)
+
+	case len(parts) == 1 && route == "GET tasks":
+		h.find(b, w, req)
+	case len(parts) == 1 && route == "POST tasks":
+		h.create(b, w, req)
+	case len(parts) == 2 && route == "GET tasks":
+		h.load(b, w, req, parts[1])
+	case len(parts) == 2 && route == "DELETE tasks":
+		h.remove(b, w, req, parts[1])
+	case len(parts) == 3 && route == "PUT tasks" && parts[2] == "description":
+		h.describe(b, w, req, parts[1])
+	case len(parts) == 3 && route == "POST tasks" && parts[2] == "rename":
+		h.rename(b, w, req, parts[1])
+	case len(parts) == 3 && route == "POST tasks" && parts[2] == "annotations":
+		h.annotate(b, w, req, parts[1])
+	case len(parts) == 4 && route == "DELETE tasks" && parts[2] == "annotations" && parts[3] == "last":
+		h.pop(b, w, req, parts[1])
+
+	case len(parts) == 1 && route == "GET timer":
+		h.status(b, w, req)
+	case len(parts) == 1 && route == "POST timer":
+		h.start(b, w, req)
+	case len(parts) == 1 && route == "DELETE timer":
+		h.stop(b, w, req)
+
+	default:
+		restFail(w, errorf(ErrNotFound, "no such endpoint"))
+	}
+}
+
+func restReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func restFail(w http.ResponseWriter, err error) {
+	if rw, ok := w.(*restWriter); ok {
+		rw.err = err
+	}
+	restReply(w, errorStatus(err), restError{
+		Error: err.Error(),
+		Code:  errorCode(err),
+	})
+}
+
+func restDecode(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		restFail(w, errorf(ErrInvalidArgument, "invalid request body: %s", err))
+		return false
+	}
+	return true
+}
+
+func (restHandler) find(b Backend, w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	//default to every annotation up until now, the same as log
+	var before time.Time
+	after := time.Now()
+	for _, p := range []struct {
+		key string
+		t   *time.Time
+	}{{"before", &before}, {"after", &after}} {
+		v := q.Get(p.key)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			restFail(w, errorf(ErrInvalidArgument, "invalid %s: %s", p.key, err))
+			return
+		}
+		*p.t = t
+	}
+
+	tasks, err := b.Find(req.Context(), q.Get("regex"), before, after)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+	restReply(w, http.StatusOK, tasks)
+}
+
+func (restHandler) create(b Backend, w http.ResponseWriter, req *http.Request) {
+	var args restNewTask
+	if !restDecode(w, req, &args) {
+		return
+	}
+	if args.Name == "" {
+		restFail(w, errorf(ErrInvalidArgument, "task name required"))
+		return
+	}
+
+	task := &Task{
+		Name:        args.Name,
+		Description: args.Description,
+	}
+	if args.Estimate != 0 {
+		task.Apply(Annotation{
+			When:          time.Now(),
+			EstimateDelta: time.Duration(args.Estimate),
+		})
+	}
+	if err := b.Save(req.Context(), task); err != nil {
+		restFail(w, err)
+		return
+	}
+	restReply(w, http.StatusCreated, task)
+}
+
+func (restHandler) load(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	task, err := b.Load(req.Context(), name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	restReply(w, http.StatusOK, task)
+}
+
+func (restHandler) remove(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	task, err := b.Load(req.Context(), name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if err := b.Remove(req.Context(), name); err != nil {
+		restFail(w, err)
+		return
+	}
+	restReply(w, http.StatusOK, task)
+}
+
+// restIfMatch checks the task is still at the revision in the If-Match
+// header, if the client sent one.
+func restIfMatch(w http.ResponseWriter, req *http.Request, task *Task) bool {
+	h := req.Header.Get("If-Match")
+	if h == "" {
+		return true
+	}
+	rev, err := strconv.ParseInt(strings.Trim(h, `"`), 10, 64)
+	if err != nil {
+		restFail(w, errorf(ErrInvalidArgument, "invalid If-Match revision: %q", h))
+		return false
+	}
+	if rev != task.Revision {
+		restFail(w, errorf(ErrConflict, "task %q is at revision %d, not %d", task.Name, task.Revision, rev))
+		return false
+	}
+	return true
+}
+
+func (restHandler) describe(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	var args restDescription
+	if !restDecode(w, req, &args) {
+		return
+	}
+	task, err := b.Load(req.Context(), name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if !restIfMatch(w, req, task) {
+		return
+	}
+	if err := b.SetDescription(req.Context(), task, args.Description); err != nil {
+		restFail(w, err)
+		return
+	}
+	task.Description = args.Description
+	restReply(w, http.StatusOK, task)
+}
+
+func (restHandler) rename(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	var args restRename
+	if !restDecode(w, req, &args) {
+		return
+	}
+	if args.Name == "" {
+		restFail(w, errorf(ErrInvalidArgument, "new task name required"))
+		return
+	}
+	if err := b.Rename(req.Context(), name, args.Name); err != nil {
+		restFail(w, err)
+		return
+	}
+	task, err := b.Load(req.Context(), args.Name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	restReply(w, http.StatusOK, task)
+}
+
+func (restHandler) annotate(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	var args restAnnotation
+	if !restDecode(w, req, &args) {
+		return
+	}
+	if args.When.IsZero() {
+		args.When = time.Now()
+	}
+	ann := Annotation{
+		When:          args.When,
+		EstimateDelta: time.Duration(args.EstimateDelta),
+		ActualDelta:   time.Duration(args.ActualDelta),
+		Focus:         args.Focus,
+	}
+
+	task, err := b.Load(req.Context(), name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if !restIfMatch(w, req, task) {
+		return
+	}
+	if err := b.AddAnnotation(req.Context(), task, ann); err != nil {
+		restFail(w, err)
+		return
+	}
+	task.Apply(ann)
+	restReply(w, http.StatusCreated, task)
+}
+
+func (restHandler) pop(b Backend, w http.ResponseWriter, req *http.Request, name string) {
+	task, err := b.Load(req.Context(), name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if len(task.Annotations) == 0 {
+		restFail(w, errorf(ErrInvalidArgument, "no annotations to undo"))
+		return
+	}
+	if !restIfMatch(w, req, task) {
+		return
+	}
+	if err := b.PopAnnotation(req.Context(), task); err != nil {
+		restFail(w, err)
+		return
+	}
+
+	//slice off the last annotation and take its deltas back out
+	anno := task.Annotations[len(task.Annotations)-1]
+	task.Annotations = task.Annotations[:len(task.Annotations)-1]
+	task.Estimate -= anno.EstimateDelta
+	task.Actual -= anno.ActualDelta
+	restReply(w, http.StatusOK, task)
+}
+
+func (restHandler) status(b Backend, w http.ResponseWriter, req *http.Request) {
+	log, err := b.Status(req.Context())
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if log == nil {
+		restReply(w, http.StatusOK, restTimer{})
+		return
+	}
+	task, err := b.Load(req.Context(), log.Name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	restReply(w, http.StatusOK, restTimer{
+		Running: true,
+		Log:     log,
+		Task:    task,
+	})
+}
+
+func (h restHandler) start(b Backend, w http.ResponseWriter, req *http.Request) {
+	var args restStart
+	if !restDecode(w, req, &args) {
+		return
+	}
+	task, err := b.Load(req.Context(), args.Name)
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+
+	//record the time on any running timer like the start command does
+	if _, _, err := b.StopTimer(req.Context(), time.Now()); err != nil {
+		restFail(w, err)
+		return
+	}
+
+	if err := b.Start(req.Context(), task.Name); err != nil {
+		restFail(w, err)
+		return
+	}
+	h.status(b, w, req)
+}
+
+func (restHandler) stop(b Backend, w http.ResponseWriter, req *http.Request) {
+	log, task, err := b.StopTimer(req.Context(), time.Now())
+	if err != nil {
+		restFail(w, err)
+		return
+	}
+	if log == nil {
+		restFail(w, errorf(ErrConflict, "not started on any task"))
+		return
+	}
+	restReply(w, http.StatusOK, restStopped{
+		Log:        log,
+		Annotation: task.Annotations[len(task.Annotations)-1],
+		Task:       task,
+	})
+}
+
+func (restHandler) users(w http.ResponseWriter, req *http.Request) {
+	if serveUsers == nil {
+		restFail(w, errorf(ErrNotFound, "serving without users"))
+		return
+	}
+	user, _, _ := serveUsers.requestUser(req)
+	if !user.Admin {
+		restFail(w, errorf(ErrUnauthorized, "only admins may list users"))
+		return
+	}
+
+	users := make([]restUser, 0, len(serveUsers.users))
+	for _, u := range serveUsers.users {
+		users = append(users, restUser{
+			Name:  u.Name,
+			Admin: u.Admin,
+		})
+	}
+	restReply(w, http.StatusOK, users)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Timeouts bounds how long connecting to and calling a backend may take and
+// how many times idempotent calls are retried while the backend is
+// unavailable. it is embedded in the configs of remote backends, and zero
+// values use the defaults. set Retries to -1 to disable retries.
+type Timeouts struct {
+	DialTimeout Duration `json:",omitempty"`
+	CallTimeout Duration `json:",omitempty"`
+	Retries     int      `json:",omitempty"`
+}
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultCallTimeout = 30 * time.Second
+	defaultRetries     = 3
+
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+func (t Timeouts) dialTimeout() time.Duration {
+	if t.DialTimeout > 0 {
+		return time.Duration(t.DialTimeout)
+	}
+	return defaultDialTimeout
+}
+
+func (t Timeouts) callTimeout() time.Duration {
+	if t.CallTimeout > 0 {
+		return time.Duration(t.CallTimeout)
+	}
+	return defaultCallTimeout
+}
+
+func (t Timeouts) retries() int {
+	switch {
+	case t.Retries < 0:
+		return 0
+	case t.Retries == 0:
+		return defaultRetries
+	}
+	return t.Retries
+}
+
+func (t Timeouts) validate() (problems []string) {
+	//negative retries disable them, so only the timeouts are checked
+	if t.DialTimeout < 0 || t.CallTimeout < 0 {
+		problems = append(problems, "DialTimeout and CallTimeout can't be negative")
+	}
+	return
+}
+
+// call runs fn with the call timeout applied to the context. running out of
+// time means the backend is unavailable.
+func (t Timeouts) call(ctx context.Context, fn func(context.Context) error) (err error) {
+	cctx, cancel := context.WithTimeout(ctx, t.callTimeout())
+	defer cancel()
+
+	err = fn(cctx)
+	if err != nil && ctx.Err() == nil && cctx.Err() == context.DeadlineExceeded {
+		err = errorf(ErrUnavailable, "call timed out after %s", t.callTimeout())
+	}
+	return
+}
+
+// retry is call for idempotent operations. it tries again with exponential
+// backoff while the backend is unavailable.
+func (t Timeouts) retry(ctx context.Context, fn func(context.Context) error) (err error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = t.call(ctx, fn)
+		if !isCode(err, ErrUnavailable) || attempt >= t.retries() {
+			return
+		}
+
+		//sleep for the backoff with up to half of it again as jitter
+		sleep := backoff + time.Duration(rand.Int63n(int64(backoff/2)))
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTimeoutsValidate(t *testing.T) {
+	if problems := (Timeouts{Retries: -1}).validate(); len(problems) != 0 {
+		t.Errorf("disabling retries: %q", problems)
+	}
+	if n := (Timeouts{Retries: -1}).retries(); n != 0 {
+		t.Errorf("%d retries when disabled", n)
+	}
+	if problems := (Timeouts{CallTimeout: -1}).validate(); len(problems) != 1 {
+		t.Errorf("a negative timeout: %q", problems)
+	}
+}
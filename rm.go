@@ -15,6 +15,8 @@ func init() {
 
 		flags: flag.NewFlagSet("rm", flag.ExitOnError),
 		run:   rm,
+
+		complete: taskArgs(1),
 	}
 
 	commands["rm"] = cmd
@@ -25,17 +27,15 @@ func rm(c *command) {
 	if len(args) != 1 {
 		c.Usage(1)
 	}
-	name := args[0]
-
-	task, err := defaultBackend.Load(name)
+	task, err := loadTaskStrictly(c.ctx, args[0])
 	if err != nil {
 		c.Error(err)
 	}
 
-	if err := defaultBackend.Remove(name); err != nil {
+	if err := defaultBackend.Remove(c.ctx, task.Name); err != nil {
 		c.Error(err)
 	}
 
-	fmt.Printf("deleted %s\n", name)
+	fmt.Printf("deleted %s\n", task.Name)
 	fmt.Println(task)
 }
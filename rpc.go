@@ -1,44 +1,158 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type RPCConfig struct {
-	Network string `json:",omitempty"`
-	Address string `json:",omitempty"`
+	Network string  `json:",omitempty"`
+	Address string  `json:",omitempty"`
+	Token   *Secret `json:",omitempty"` //api token for servers with users
+	User    string  `json:",omitempty"` //lets admins act on another user's data
+
+	TLS        bool   `json:",omitempty"` //use tls with the system roots
+	CA         string `json:",omitempty"` //path to ca certificates for the server
+	Cert       string `json:",omitempty"` //path to a client certificate
+	Key        string `json:",omitempty"` //path to the client certificate key
+	ServerName string `json:",omitempty"` //overrides the name verified on the server certificate
+
+	Timeouts
+}
+
+func (c *RPCConfig) validate() (problems []string) {
+	switch c.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		problems = append(problems, fmt.Sprintf("Network %q is not one of tcp, tcp4, tcp6 or unix", c.Network))
+	}
+	if c.Address == "" {
+		problems = append(problems, "Address is required")
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		problems = append(problems, "Cert and Key must be given together")
+	} else if _, err := clientTLSConfig(c); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return append(problems, c.Timeouts.validate()...)
+}
+
+// rpcProtocol is the version of the rpc methods and their arguments. the
+// client and server check they match when connecting.
+const rpcProtocol = 2
+
+func init() {
+	backendTypes["rpc"] = &backendType{
+		section: "RPCConfig",
+		config:  func() interface{} { return &RPCConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openRPC(conf.(*RPCConfig)) },
+	}
 }
 
 func openRPC(c *RPCConfig) (b Backend, err error) {
-	cl, err := rpc.DialHTTP(c.Network, c.Address)
+	conf, err := clientTLSConfig(c)
 	if err != nil {
 		return
 	}
-	b = &rpcClient{cl: cl}
+	token, err := c.Token.reveal()
+	if err != nil {
+		return
+	}
+	r := &rpcClient{conf: c, tls: conf, token: token}
+
+	//connect up front so a bad address is reported when loading the backend
+	ctx, cancel := context.WithTimeout(context.Background(), c.dialTimeout())
+	defer cancel()
+	if _, err = r.client(ctx); err != nil {
+		return
+	}
+	b = r
 	return
 }
 
-//
-// handling error types: flatten to string
-//
+func dialRPC(ctx context.Context, c *RPCConfig, conf *tls.Config, token string) (cl *rpc.Client, err error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout()}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		err = errorf(ErrUnavailable, "%s", err)
+		return
+	}
+	if conf != nil {
+		conn = tls.Client(conn, conf)
+	}
 
-func init() {
-	gob.Register(errString(""))
+	//the tls and http handshakes count as dialing too
+	conn.SetDeadline(time.Now().Add(c.dialTimeout()))
+	if err = rpcHandshake(conn, c, token); err != nil {
+		conn.Close()
+		if errorCode(err) == "" {
+			err = errorf(ErrUnavailable, "%s", err)
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	cl = rpc.NewClient(conn)
+	return
 }
 
-type errString string
+// rpcHandshake does what rpc.DialHTTP does to get to the rpc endpoint, but
+// sends the credentials along with the CONNECT.
+func rpcHandshake(conn net.Conn, c *RPCConfig, token string) (err error) {
+	header := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	header += "X-Est-Protocol: " + strconv.Itoa(rpcProtocol) + "\n"
+	if token != "" {
+		header += "Authorization: Bearer " + token + "\n"
+	}
+	if c.User != "" {
+		header += "X-Est-User: " + c.User + "\n"
+	}
+	if _, err = io.WriteString(conn, header+"\n"); err != nil {
+		return
+	}
 
-func (e errString) Error() string {
-	return string(e)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			err = errorf(ErrUnauthorized, "%s", strings.TrimSpace(string(body)))
+		case http.StatusBadRequest:
+			err = errorf(ErrInvalidArgument, "%s", strings.TrimSpace(string(body)))
+		}
+		return
+	}
+	if v := resp.Header.Get("X-Est-Protocol"); v != strconv.Itoa(rpcProtocol) {
+		if v == "" {
+			v = "none"
+		}
+		err = errorf(ErrInvalidArgument, "server speaks rpc protocol %s but this est speaks %d. use the same version of est on both", v, rpcProtocol)
+	}
+	return
 }
 
+//
+// handling error types: rebuild the codes sent by the server
+//
+
 func wrapError(e *error) {
-	if *e != nil {
-		*e = errString(fmt.Sprint(*e))
-	}
+	_, server := (*e).(rpc.ServerError)
+	decodeError(e, server)
 }
 
 //
@@ -46,9 +160,63 @@ func wrapError(e *error) {
 //
 
 type rpcClient struct {
+	conf  *RPCConfig
+	tls   *tls.Config
+	token string
+
+	mu sync.Mutex
 	cl *rpc.Client
 }
 
+// client returns the connection to the server, dialing a new one if the last
+// one was lost.
+func (r *rpcClient) client(ctx context.Context) (cl *rpc.Client, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cl == nil {
+		if r.cl, err = dialRPC(ctx, r.conf, r.tls, r.token); err != nil {
+			return
+		}
+	}
+	cl = r.cl
+	return
+}
+
+// drop closes the connection so the next call dials a new one.
+func (r *rpcClient) drop(cl *rpc.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cl == cl {
+		r.cl = nil
+	}
+	cl.Close()
+}
+
+func (r *rpcClient) invoke(ctx context.Context, method string, args, reply interface{}) (err error) {
+	defer wrapError(&err)
+	cl, err := r.client(ctx)
+	if err != nil {
+		return
+	}
+
+	call := cl.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		//the connection is in an unknown state with the call still running
+		//on it, so throw it away
+		err = ctx.Err()
+		r.drop(cl)
+		return
+	}
+
+	if _, server := err.(rpc.ServerError); err != nil && !server {
+		r.drop(cl)
+	}
+	return
+}
+
 type None struct{}
 
 var nul = new(None)
@@ -73,90 +241,128 @@ type RpcRenameArgs struct {
 	Oldn, Newn string
 }
 
+type RpcStopTimerReply struct {
+	Log  *StartLog
+	Task *Task
+}
+
 type RpcStatusReply struct {
 	Log    *StartLog
 	Exists bool
 }
 
-func (r *rpcClient) Save(task *Task) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Save", task, nul)
+func (r *rpcClient) Save(ctx context.Context, task *Task) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.Save", task, nul)
+	})
 	return
 }
 
-func (r *rpcClient) SetDescription(task *Task, desc string) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.SetDescription", RpcSetDescriptionArgs{
-		Task: task,
-		Desc: desc,
-	}, nul)
+func (r *rpcClient) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.SetDescription", RpcSetDescriptionArgs{
+			Task: task,
+			Desc: desc,
+		}, nul)
+	})
+	if err == nil {
+		//the server moved its copy to the next revision
+		task.Revision++
+	}
 	return
 }
 
-func (r *rpcClient) AddAnnotation(task *Task, a Annotation) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.AddAnnotation", RpcAddAnnotationArgs{
-		Task: task,
-		A:    a,
-	}, nul)
+func (r *rpcClient) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.AddAnnotation", RpcAddAnnotationArgs{
+			Task: task,
+			A:    a,
+		}, nul)
+	})
+	if err == nil {
+		task.Revision++
+	}
 	return
 }
 
-func (r *rpcClient) PopAnnotation(task *Task) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.PopAnnotation", task, nul)
+func (r *rpcClient) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.PopAnnotation", task, nul)
+	})
+	if err == nil {
+		task.Revision++
+	}
 	return
 }
 
-func (r *rpcClient) Load(name string) (task *Task, err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Load", name, &task)
+func (r *rpcClient) Load(ctx context.Context, name string) (task *Task, err error) {
+	err = r.conf.retry(ctx, func(ctx context.Context) error {
+		task = nil
+		return r.invoke(ctx, "Estimate.Load", name, &task)
+	})
 	return
 }
 
-func (r *rpcClient) Start(name string) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Start", name, nul)
+func (r *rpcClient) Start(ctx context.Context, name string) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.Start", name, nul)
+	})
 	return
 }
 
-func (r *rpcClient) Stop() (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Stop", nul, nul)
+func (r *rpcClient) Stop(ctx context.Context) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.Stop", nul, nul)
+	})
 	return
 }
 
-func (r *rpcClient) Status() (log *StartLog, err error) {
-	defer wrapError(&err)
+func (r *rpcClient) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	var reply RpcStopTimerReply
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.StopTimer", when, &reply)
+	})
+	log, task = reply.Log, reply.Task
+	return
+}
+
+func (r *rpcClient) Status(ctx context.Context) (log *StartLog, err error) {
 	var reply RpcStatusReply
-	err = r.cl.Call("Estimate.Status", nul, &reply)
+	err = r.conf.retry(ctx, func(ctx context.Context) error {
+		reply = RpcStatusReply{}
+		return r.invoke(ctx, "Estimate.Status", nul, &reply)
+	})
 	if reply.Exists {
 		log = reply.Log
 	}
 	return
 }
 
-func (r *rpcClient) Find(regex string, before, after time.Time) (tasks []*Task, err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Find", RpcFindArgs{
-		Regex:  regex,
-		Before: before,
-		After:  after,
-	}, &tasks)
+func (r *rpcClient) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	err = r.conf.retry(ctx, func(ctx context.Context) error {
+		tasks = nil
+		return r.invoke(ctx, "Estimate.Find", RpcFindArgs{
+			Regex:  regex,
+			Before: before,
+			After:  after,
+		}, &tasks)
+	})
 	return
 }
 
-func (r *rpcClient) Rename(oldn, newn string) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Rename", RpcRenameArgs{
-		Oldn: oldn,
-		Newn: newn,
-	}, nul)
+func (r *rpcClient) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.Rename", RpcRenameArgs{
+			Oldn: oldn,
+			Newn: newn,
+		}, nul)
+	})
 	return
 }
 
-func (r *rpcClient) Remove(name string) (err error) {
-	defer wrapError(&err)
-	err = r.cl.Call("Estimate.Remove", name, nul)
+func (r *rpcClient) Remove(ctx context.Context, name string) (err error) {
+	err = r.conf.call(ctx, func(ctx context.Context) error {
+		return r.invoke(ctx, "Estimate.Remove", name, nul)
+	})
 	return
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// serveCodec is the gob codec net/rpc uses, extended to log every call with
+// its latency and error, apply timeouts, and stop reading requests when serve
+// shuts down.
+type serveCodec struct {
+	conn   net.Conn
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	user   string
+	closed bool
+
+	//hangup cancels the calls in flight once the client is gone
+	hangup context.CancelFunc
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+}
+
+func newServeCodec(conn net.Conn, user string) *serveCodec {
+	buf := bufio.NewWriter(conn)
+	return &serveCodec{
+		conn:    conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		user:    user,
+		pending: map[uint64]time.Time{},
+	}
+}
+
+func deadline(timeout time.Duration) (t time.Time) {
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	return
+}
+
+func (c *serveCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	if !rpcConns.readDeadline(c.conn, deadline(serveParams.idleTimeout)) {
+		return io.EOF
+	}
+	if err = c.dec.Decode(r); err != nil {
+		//net/rpc lets the calls in flight finish after a read fails, so only
+		//cancel them when the client is gone, not when shutdown or the idle
+		//timeout cut the read short
+		if c.hangup != nil && !rpcConns.isClosing() && !isTimeout(err) {
+			c.hangup()
+		}
+		return
+	}
+
+	c.mu.Lock()
+	c.pending[r.Seq] = time.Now()
+	c.mu.Unlock()
+	return
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (c *serveCodec) ReadRequestBody(body interface{}) error {
+	c.conn.SetReadDeadline(deadline(serveParams.readTimeout))
+	return c.dec.Decode(body)
+}
+
+func (c *serveCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mu.Lock()
+	start := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+
+	latency := time.Since(start)
+	rpcMetrics.observe(r.ServiceMethod, latency, r.Error != "")
+
+	attrs := []interface{}{
+		"method", r.ServiceMethod,
+		"user", c.user,
+		"remote", c.conn.RemoteAddr().String(),
+		"latency", latency,
+	}
+	if r.Error != "" {
+		serveLog.Warn("rpc", append(attrs, "error", r.Error)...)
+	} else {
+		serveLog.Info("rpc", attrs...)
+	}
+
+	c.conn.SetWriteDeadline(deadline(serveParams.writeTimeout))
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			//gob couldn't encode the header. shouldn't happen, so close
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			//was a gob problem encoding the body but the header has been
+			//written. shut down the connection to signal that it is broken.
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serveCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+//
+// connection tracking for graceful shutdown
+//
+
+var rpcConns = &connSet{conns: map[net.Conn]struct{}{}}
+
+// connSet tracks the hijacked rpc connections, which http.Server.Shutdown
+// knows nothing about.
+type connSet struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+func (s *connSet) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *connSet) done(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// readDeadline sets the deadline for reading the next request, unless
+// shutdown has started and already cut reads short.
+func (s *connSet) readDeadline(conn net.Conn, t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	conn.SetReadDeadline(t)
+	return true
+}
+
+func (s *connSet) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// shutdown stops every connection from reading new requests and waits for the
+// calls in flight to finish writing their responses.
+func (s *connSet) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		//wake up any reads waiting for the next request. net/rpc waits for
+		//outstanding calls to respond before it closes the codec.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
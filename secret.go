@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+)
+
+// Secret is a credential in the config. it's written either as the value
+// itself or as where to get it:
+//
+//	"Password": "hunter2"
+//	"Password": {"File": "/home/me/.est-password"}
+//	"Password": {"Env": "MONGO_PASSWORD"}
+//	"Password": {"Command": "pass show est/mongo"}
+type Secret struct {
+	Value   string `json:",omitempty"`
+	File    string `json:",omitempty"` //read from a file only the user can read
+	Env     string `json:",omitempty"` //read from an environment variable
+	Command string `json:",omitempty"` //run through the shell, using what it prints
+}
+
+const redacted = "********"
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s.File == "" && s.Env == "" && s.Command == "" {
+		return json.Marshal(s.Value)
+	}
+	type plain Secret
+	return json.Marshal(plain(s))
+}
+
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*s = Secret{}
+		return json.Unmarshal(b, &s.Value)
+	}
+	type plain Secret
+	return json.Unmarshal(b, (*plain)(s))
+}
+
+func (s *Secret) isSet() bool {
+	return s != nil && *s != Secret{}
+}
+
+// String describes the secret without giving it away.
+func (s *Secret) String() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.File != "":
+		return "file " + s.File
+	case s.Env != "":
+		return "env " + s.Env
+	case s.Command != "":
+		return "command " + s.Command
+	case s.Value != "":
+		return redacted
+	}
+	return ""
+}
+
+// reveal gets the value of the secret from wherever it's kept. a missing
+// secret is empty.
+func (s *Secret) reveal() (value string, err error) {
+	switch {
+	case s == nil:
+	case s.File != "":
+		var info os.FileInfo
+		if info, err = os.Stat(s.File); err != nil {
+			break
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			err = fmt.Errorf("%s can be read by other users. chmod 600 it", s.File)
+			break
+		}
+		var data []byte
+		data, err = os.ReadFile(s.File)
+		value = strings.TrimRight(string(data), "\r\n")
+
+	case s.Env != "":
+		var ok bool
+		if value, ok = os.LookupEnv(s.Env); !ok {
+			err = fmt.Errorf("%s is not set", s.Env)
+		}
+
+	case s.Command != "":
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", s.Command)
+		cmd.Stderr = &stderr
+		out, cerr := cmd.Output()
+		if cerr != nil {
+			err = fmt.Errorf("%s: %s %s", s.Command, cerr, strings.TrimSpace(stderr.String()))
+			break
+		}
+		value = strings.TrimRight(string(out), "\r\n")
+
+	default:
+		value = s.Value
+	}
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "unable to get secret: %s", err)
+	}
+	return
+}
+
+// eachSecret calls fn with every secret in the value, looking through the
+// sections of a config and nested configs like those of a mirror.
+func eachSecret(v reflect.Value, fn func(s *Secret)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			eachSecret(v.Elem(), fn)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if e := v.Elem(); e.Kind() == reflect.Ptr {
+			eachSecret(e, fn)
+		} else if v.CanSet() {
+			v.Set(eachSecretCopy(e, fn))
+		}
+	case reflect.Map:
+		//map values can't be changed in place, so change a copy and put
+		//it back
+		for _, key := range v.MapKeys() {
+			v.SetMapIndex(key, eachSecretCopy(v.MapIndex(key), fn))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			eachSecret(v.Index(i), fn)
+		}
+	case reflect.Struct:
+		if s, ok := v.Addr().Interface().(*Secret); ok {
+			fn(s)
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				eachSecret(v.Field(i), fn)
+			}
+		}
+	}
+}
+
+func eachSecretCopy(v reflect.Value, fn func(s *Secret)) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	eachSecret(c, fn)
+	return c
+}
+
+// redact copies the value with the values of its secrets hidden.
+func redact(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	r := reflect.New(reflect.TypeOf(v))
+	json.Unmarshal(data, r.Interface())
+	eachSecret(r, func(s *Secret) {
+		if s.Value != "" {
+			s.Value = redacted
+		}
+	})
+	return r.Elem().Interface()
+}
+
+// plainSecrets tells if the config holds the value of any secret.
+func plainSecrets(c *Config) (found bool) {
+	eachSecret(reflect.ValueOf(c), func(s *Secret) {
+		found = found || s.Value != ""
+	})
+	return
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testSecretConfig() *Config {
+	return &Config{
+		Backend: "mirror",
+		Sections: map[string]interface{}{
+			"MongoConfig": &MongoConfig{Host: "localhost", Password: &Secret{Value: "hunter2"}},
+			"RPCConfig":   &RPCConfig{Address: "localhost:1", Token: &Secret{Value: "tok-secret"}},
+			"MirrorConfig": &MirrorConfig{
+				Primary: &Config{Backend: "mongo", Sections: map[string]interface{}{
+					"MongoConfig": &MongoConfig{Password: &Secret{Value: "nested-secret"}},
+				}},
+			},
+		},
+	}
+}
+
+func TestRedactSections(t *testing.T) {
+	c := testSecretConfig()
+	data, err := json.Marshal(redact(*c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "tok-secret", "nested-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("%s not redacted in %s", secret, data)
+		}
+	}
+	if n := strings.Count(string(data), redacted); n != 3 {
+		t.Errorf("%d secrets redacted in %s", n, data)
+	}
+
+	//the config itself keeps its secrets
+	if v, _ := c.Sections["MongoConfig"].(*MongoConfig).Password.reveal(); v != "hunter2" {
+		t.Errorf("redacting changed the config's password to %q", v)
+	}
+}
+
+func TestPlainSecretsInSections(t *testing.T) {
+	c := testSecretConfig()
+	if !plainSecrets(c) {
+		t.Error("plain secrets in the sections not found")
+	}
+
+	c = &Config{Backend: "mongo", Sections: map[string]interface{}{
+		"MongoConfig": &MongoConfig{Password: &Secret{Env: "MONGO_PASSWORD"}},
+	}}
+	if plainSecrets(c) {
+		t.Error("a secret kept in the environment counted as plain")
+	}
+}
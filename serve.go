@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func init() {
 	cmd := &command{
-		short: "serves rpc requests as a backend",
-		long:  "dofasdf",
-		usage: "serve <address>",
+		short: "serves rpc and json api requests as a backend",
+		long:  "Serves the backend over http on the address, for the rpc backend of other ests at /_goRPC_ and as a json api under /api, described by /api/openapi.json. /healthz reports whether the backend answers and /metrics has rpc call counts and latencies and the number of tasks and running timers for prometheus. Without -users anyone who can connect may use the data. With it every request needs the Bearer token of a user in the file, made with gentoken, and each user gets their own tasks and timer; admins may act as another user with the X-Est-User header, and only they may read /metrics. -cert and -key serve tls, and -clientca also requires client certificates signed by it. The timeouts bound reading a request, writing its response, which also cancels the backend call, and waiting for the next request on a connection. On an interrupt serve stops taking requests and waits up to -shutdowntimeout for the ones in flight.",
+		usage: "serve [-users=] [-cert= -key= [-clientca=]] [-readtimeout= -writetimeout= -idletimeout= -shutdowntimeout=] <address>",
 
 		needsBackend: true,
 
@@ -18,15 +27,104 @@ func init() {
 		run:   serve,
 	}
 
+	cmd.flags.StringVar(&serveParams.users, "users", "", "path to a users file. requires api tokens and keeps separate data per user")
+	cmd.flags.StringVar(&serveParams.cert, "cert", "", "path to a certificate to serve tls with")
+	cmd.flags.StringVar(&serveParams.key, "key", "", "path to the key for the certificate")
+	cmd.flags.StringVar(&serveParams.clientCA, "clientca", "", "path to ca certificates that client certificates must be signed by")
+	cmd.flags.DurationVar(&serveParams.readTimeout, "readtimeout", 30*time.Second, "maximum time to read a request")
+	cmd.flags.DurationVar(&serveParams.writeTimeout, "writetimeout", 30*time.Second, "maximum time to write a response")
+	cmd.flags.DurationVar(&serveParams.idleTimeout, "idletimeout", 2*time.Minute, "maximum time to wait for the next request on a connection")
+	cmd.flags.DurationVar(&serveParams.shutdownTimeout, "shutdowntimeout", 30*time.Second, "maximum time to wait for requests in flight on shutdown")
+
 	commands["serve"] = cmd
 }
 
+var serveParams struct {
+	users    string
+	cert     string
+	key      string
+	clientCA string
+
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+}
+
+// serveLog receives a line for every request serve handles.
+var serveLog = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
 func serve(c *command) {
 	args := c.flags.Args()
 	if len(args) == 0 {
 		c.Usage(1)
 	}
-	http.ListenAndServe(args[0], nil)
+
+	if serveParams.users != "" {
+		if _, ok := defaultBackend.(namespacer); !ok {
+			c.Error(fmt.Errorf("backend %q does not support per user data", defaultConfig.Backend))
+		}
+		users, err := loadUsers(serveParams.users)
+		if err != nil {
+			c.Error(err)
+		}
+		serveUsers = users
+	} else {
+		serveLog.Warn("no users file given. serving without authentication")
+	}
+
+	srv := &http.Server{
+		ReadTimeout:  serveParams.readTimeout,
+		WriteTimeout: serveParams.writeTimeout,
+		IdleTimeout:  serveParams.idleTimeout,
+	}
+	if serveParams.cert != "" || serveParams.key != "" {
+		conf, err := serverTLSConfig(serveParams.cert, serveParams.key, serveParams.clientCA)
+		if err != nil {
+			c.Error(err)
+		}
+		srv.TLSConfig = conf
+	} else if serveParams.clientCA != "" {
+		c.Error(fmt.Errorf("-clientca requires -cert and -key"))
+	}
+
+	//listen up front so a bad address is reported before anything else
+	l, err := net.Listen("tcp", args[0])
+	if err != nil {
+		c.Error(fmt.Errorf("unable to listen on %q: %s", args[0], err))
+	}
+	serveLog.Info("serving", "address", l.Addr().String(), "tls", srv.TLSConfig != nil)
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ServeTLS(l, "", "")
+		} else {
+			errs <- srv.Serve(l)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		c.Error(err)
+	case sig := <-sigs:
+		serveLog.Info("shutting down", "signal", sig.String())
+	}
+
+	//stop accepting and wait for the requests in flight, including the calls
+	//on hijacked rpc connections that http.Server doesn't track
+	ctx, cancel := context.WithTimeout(context.Background(), serveParams.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		c.Error(fmt.Errorf("shutdown: %s", err))
+	}
+	if err := rpcConns.shutdown(ctx); err != nil {
+		c.Error(fmt.Errorf("shutdown: %s", err))
+	}
+	serveLog.Info("shut down")
 }
 
 //
@@ -34,51 +132,143 @@ func serve(c *command) {
 //
 
 func init() {
-	if err := rpc.RegisterName("Estimate", rpcServer{}); err != nil {
-		panic(err)
+	http.HandleFunc(rpc.DefaultRPCPath, serveRPC)
+}
+
+// serveRPC authenticates the connection and serves rpcs on it against the
+// backend for the user. it does the work of rpc.Server.ServeHTTP so that the
+// connection can use serveCodec.
+func serveRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	if v := req.Header.Get("X-Est-Protocol"); v != strconv.Itoa(rpcProtocol) {
+		if v == "" {
+			v = "none"
+		}
+		msg := fmt.Sprintf("client speaks rpc protocol %s but the server speaks %d. use the same version of est on both", v, rpcProtocol)
+		serveLog.Warn("rpc connect", "remote", req.RemoteAddr, "error", msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	b, user, err := requestBackend(req)
+	if err != nil {
+		serveLog.Warn("rpc connect", "remote", req.RemoteAddr, "error", err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Estimate", rpcServer{b, ctx}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		serveLog.Error("rpc hijack", "remote", req.RemoteAddr, "error", err.Error())
+		return
 	}
-	rpc.HandleHTTP()
+	if !rpcConns.add(conn) {
+		conn.Close()
+		return
+	}
+	defer rpcConns.done(conn)
+
+	//the http server's deadlines no longer apply. serveCodec sets its own.
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(conn, "HTTP/1.0 200 Connected to Go RPC\nX-Est-Protocol: %d\n\n", rpcProtocol)
+	codec := newServeCodec(conn, user)
+	codec.hangup = cancel
+	srv.ServeCodec(codec)
 }
 
-type rpcServer struct{}
+type rpcServer struct {
+	b   Backend
+	ctx context.Context //ends when the client goes away
+}
+
+// callContext bounds a backend call made for a client. it ends with the
+// client, or once the reply could no longer be written in time.
+func callContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if serveParams.writeTimeout > 0 {
+		return context.WithTimeout(parent, serveParams.writeTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+func (s rpcServer) Save(task *Task, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.Save(ctx, task)
+	return
+}
 
-func (rpcServer) Save(task *Task, nul *None) (err error) {
-	err = defaultBackend.Save(task)
+func (s rpcServer) SetDescription(args *RpcSetDescriptionArgs, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.SetDescription(ctx, args.Task, args.Desc)
 	return
 }
 
-func (rpcServer) SetDescription(args *RpcSetDescriptionArgs, nul *None) (err error) {
-	err = defaultBackend.SetDescription(args.Task, args.Desc)
+func (s rpcServer) AddAnnotation(args *RpcAddAnnotationArgs, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.AddAnnotation(ctx, args.Task, args.A)
 	return
 }
 
-func (rpcServer) AddAnnotation(args *RpcAddAnnotationArgs, nul *None) (err error) {
-	err = defaultBackend.AddAnnotation(args.Task, args.A)
+func (s rpcServer) PopAnnotation(task *Task, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.PopAnnotation(ctx, task)
 	return
 }
 
-func (rpcServer) PopAnnotation(task *Task, nul *None) (err error) {
-	err = defaultBackend.PopAnnotation(task)
+func (s rpcServer) Load(name string, task **Task) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	*task, err = s.b.Load(ctx, name)
 	return
 }
 
-func (rpcServer) Load(name string, task **Task) (err error) {
-	*task, err = defaultBackend.Load(name)
+func (s rpcServer) Start(name string, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.Start(ctx, name)
 	return
 }
 
-func (rpcServer) Start(name string, nul *None) (err error) {
-	err = defaultBackend.Start(name)
+func (s rpcServer) Stop(nula *None, nulb *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.Stop(ctx)
 	return
 }
 
-func (rpcServer) Stop(nula *None, nulb *None) (err error) {
-	err = defaultBackend.Stop()
+func (s rpcServer) StopTimer(when time.Time, reply *RpcStopTimerReply) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	reply.Log, reply.Task, err = s.b.StopTimer(ctx, when)
 	return
 }
 
-func (rpcServer) Status(nul *None, reply *RpcStatusReply) (err error) {
-	log, err := defaultBackend.Status()
+func (s rpcServer) Status(nul *None, reply *RpcStatusReply) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	log, err := s.b.Status(ctx)
 
 	//exsists is the assertion that the log is not nil
 	reply.Exists = (log != nil)
@@ -92,17 +282,26 @@ func (rpcServer) Status(nul *None, reply *RpcStatusReply) (err error) {
 	return
 }
 
-func (rpcServer) Find(args *RpcFindArgs, tasks *[]*Task) (err error) {
-	*tasks, err = defaultBackend.Find(args.Regex, args.Before, args.After)
+func (s rpcServer) Find(args *RpcFindArgs, tasks *[]*Task) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	*tasks, err = s.b.Find(ctx, args.Regex, args.Before, args.After)
 	return
 }
 
-func (rpcServer) Rename(args *RpcRenameArgs, nul *None) (err error) {
-	err = defaultBackend.Rename(args.Oldn, args.Newn)
+func (s rpcServer) Rename(args *RpcRenameArgs, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.Rename(ctx, args.Oldn, args.Newn)
 	return
 }
 
-func (rpcServer) Remove(name string, nul *None) (err error) {
-	err = defaultBackend.Remove(name)
+func (s rpcServer) Remove(name string, nul *None) (err error) {
+	defer encodeError(&err)
+	ctx, cancel := callContext(s.ctx)
+	defer cancel()
+	err = s.b.Remove(ctx, name)
 	return
 }
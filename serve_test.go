@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowBackend takes a while to load, and gives up if its context ends first.
+type slowBackend struct {
+	Backend
+}
+
+func (s slowBackend) Load(ctx context.Context, name string) (*Task, error) {
+	select {
+	case <-time.After(200 * time.Millisecond):
+		return s.Backend.Load(ctx, name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestShutdownDrainsCalls(t *testing.T) {
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(t.TempDir(), "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	testSave(t, b, "slow")
+	defaultBackend = slowBackend{b}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{}
+	go srv.Serve(l)
+	client, err := openRPC(&RPCConfig{Network: "tcp", Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rpcConns.closing = false }()
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Load(ctx, "slow")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdown)
+	if err := rpcConns.shutdown(shutdown); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("the call in flight didn't finish: %v", err)
+	}
+}
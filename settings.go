@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// setting is a value in the config named by its path, like
+// "RPCConfig.Address", with the environment variable that overrides it, like
+// EST_RPC_ADDRESS.
+type setting struct {
+	key     string
+	env     string
+	section string //the backend section holding it, if any
+	index   []int  //field indexes from the Config or the section
+}
+
+// settings lists every value in a Config. the fields of a section are
+// settings of their own, and anything else is a single setting.
+func settings() (s []setting) {
+	section := func(t reflect.Type, key string, index []int) []setting {
+		env := "EST_" + envName(strings.TrimSuffix(key, "Config")) + "_"
+		return sectionSettings(t, key+".", env, index)
+	}
+
+	s = append(s, setting{key: "Backend", env: "EST_BACKEND", index: []int{0}})
+	for _, name := range backendNames() {
+		t := backendTypes[name]
+		ss := section(reflect.TypeOf(t.config()).Elem(), t.section, nil)
+		for i := range ss {
+			ss[i].section = t.section
+		}
+		s = append(s, ss...)
+	}
+	for _, name := range []string{"Offline", "Timer", "Daemon"} {
+		f, _ := reflect.TypeOf(Config{}).FieldByName(name)
+		s = append(s, section(f.Type.Elem(), f.Name, f.Index)...)
+	}
+	return
+}
+
+func sectionSettings(t reflect.Type, key, env string, index []int) (s []setting) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fi := append(append([]int(nil), index...), i)
+
+		//embedded structs like Timeouts read as part of the section
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			s = append(s, sectionSettings(f.Type, key, env, fi)...)
+			continue
+		}
+		s = append(s, setting{key: key + f.Name, env: env + envName(f.Name), index: fi})
+	}
+	return
+}
+
+// findSetting looks up a setting by its key, ignoring case.
+func findSetting(key string) (s setting, ok bool) {
+	for _, s = range settings() {
+		if strings.EqualFold(s.key, key) {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// envName turns a field name like ServerName into SERVER_NAME.
+func envName(name string) string {
+	r := []rune(name)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) &&
+			(unicode.IsLower(r[i-1]) || i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// value returns the field in the config. missing sections are created if
+// alloc is set, and otherwise give an invalid value.
+func (s setting) value(c *Config, alloc bool) (v reflect.Value) {
+	v = reflect.ValueOf(c).Elem()
+	if s.section != "" {
+		section, ok := c.Sections[s.section]
+		if !ok {
+			if !alloc {
+				return reflect.Value{}
+			}
+			_, t := sectionType(s.section)
+			section = t.config()
+			if c.Sections == nil {
+				c.Sections = map[string]interface{}{}
+			}
+			c.Sections[s.section] = section
+		}
+		v = reflect.ValueOf(section)
+	}
+
+	for _, i := range s.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return
+}
+
+// isSet tells if the config has a value for the setting.
+func (s setting) isSet(c *Config) bool {
+	v := s.value(c, false)
+	return v.IsValid() && !v.IsZero()
+}
+
+// get formats the value of the setting. values that aren't a string, number,
+// bool or duration are formatted as json, and secrets aren't given away.
+func (s setting) get(c *Config) string {
+	v := s.value(c, false)
+	if !v.IsValid() {
+		return ""
+	}
+	switch x := v.Interface().(type) {
+	case Duration:
+		return time.Duration(x).String()
+	case *Secret:
+		return x.String()
+	case string:
+		return x
+	case bool, int:
+		return fmt.Sprint(x)
+	}
+	data, _ := json.Marshal(redact(v.Interface()))
+	return string(data)
+}
+
+// set parses the value into the setting, the way get formats it.
+func (s setting) set(c *Config, value string) (err error) {
+	v := s.value(c, true)
+	switch v.Interface().(type) {
+	case Duration:
+		var d time.Duration
+		if d, err = time.ParseDuration(value); err == nil {
+			v.Set(reflect.ValueOf(Duration(d)))
+		}
+	case *Secret:
+		//a secret is its value unless it's json saying where to find it
+		sec := &Secret{Value: value}
+		if strings.HasPrefix(value, "{") {
+			err = json.Unmarshal([]byte(value), sec)
+		}
+		v.Set(reflect.ValueOf(sec))
+	case string:
+		v.SetString(value)
+	case bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			v.SetBool(b)
+		}
+	case int:
+		var n int
+		if n, err = strconv.Atoi(value); err == nil {
+			v.SetInt(int64(n))
+		}
+	default:
+		err = json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "invalid value for %s: %s", s.key, err)
+	}
+	return
+}
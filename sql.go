@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLConfig is for a backend in a sql database: sqlite for local use or
+// postgres for sharing.
+type SQLConfig struct {
+	Driver string `json:",omitempty"` //sqlite or postgres. default sqlite
+	DSN    string `json:",omitempty"` //data source. default $HOME/.est.sqlite for sqlite
+
+	Timeouts
+}
+
+func (c *SQLConfig) validate() (problems []string) {
+	switch c.Driver {
+	case "", "sqlite":
+	case "postgres":
+		if c.DSN == "" {
+			problems = append(problems, "DSN is required for postgres")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Driver %q is not sqlite or postgres", c.Driver))
+	}
+	return append(problems, c.Timeouts.validate()...)
+}
+
+// sqlSchema works on both sqlite and postgres. times are unix nanoseconds.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS est_meta (
+		name VARCHAR(64) PRIMARY KEY,
+		value VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS est_tasks (
+		ns VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL,
+		revision BIGINT NOT NULL,
+		estimate BIGINT NOT NULL,
+		actual BIGINT NOT NULL,
+		PRIMARY KEY (ns, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS est_annotations (
+		ns VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		seq INTEGER NOT NULL,
+		at BIGINT NOT NULL,
+		estimate_delta BIGINT NOT NULL,
+		actual_delta BIGINT NOT NULL,
+		focus BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (ns, name, seq)
+	)`,
+	`CREATE INDEX IF NOT EXISTS est_annotations_at ON est_annotations (ns, at)`,
+	`CREATE TABLE IF NOT EXISTS est_timers (
+		ns VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		started BIGINT NOT NULL
+	)`,
+}
+
+// sqlColumns add to the tables of databases made by older versions of est.
+// they don't change any data, so they run on open instead of being schema
+// migrations. est_meta records how many have run, and sqlSchema already has
+// them for new databases.
+var sqlColumns = []string{
+	`ALTER TABLE est_annotations ADD COLUMN focus BOOLEAN NOT NULL DEFAULT FALSE`,
+}
+
+func init() {
+	backendTypes["sql"] = &backendType{
+		section: "SQLConfig",
+		config:  func() interface{} { return &SQLConfig{} },
+		open:    func(conf interface{}) (Backend, error) { return openSQL(conf.(*SQLConfig)) },
+	}
+}
+
+func openSQL(c *SQLConfig) (b Backend, err error) {
+	driverName, dsn := c.Driver, c.DSN
+	if driverName == "" {
+		driverName = "sqlite"
+	}
+	if driverName == "sqlite" && dsn == "" {
+		dsn = os.ExpandEnv("$HOME/.est.sqlite")
+	}
+	if driverName != "sqlite" && driverName != "postgres" {
+		err = errorf(ErrInvalidArgument, "unknown sql driver: %q", driverName)
+		return
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return
+	}
+	if driverName == "sqlite" {
+		//sqlite allows one writer, so share a connection instead of waiting
+		//on the file lock
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &sqlBackend{db: db, postgres: driverName == "postgres", conf: c}
+	ctx, cancel := context.WithTimeout(context.Background(), c.dialTimeout())
+	defer cancel()
+	err = s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+		for _, stmt := range sqlSchema {
+			if _, err = tx.ExecContext(ctx, stmt); err != nil {
+				return
+			}
+		}
+		if err = s.addColumns(ctx, tx); err != nil {
+			return
+		}
+		return s.stampSchema(ctx, tx)
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	b = s
+	return
+}
+
+type sqlBackend struct {
+	db       *sql.DB
+	postgres bool
+	conf     *SQLConfig
+	ns       string //user the rows belong to. empty without users
+}
+
+// Namespace returns a backend on the rows for the user.
+func (s *sqlBackend) Namespace(user string) Backend {
+	n := *s
+	n.ns = user
+	return &n
+}
+
+// q rewrites the ? placeholders in a query for postgres.
+func (s *sqlBackend) q(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlError gives a code to the errors from the database. name is the task
+// the operation was on.
+func sqlError(e *error, name string) {
+	err := *e
+	if err == nil || errorCode(err) != "" {
+		return
+	}
+	msg := err.Error()
+	var netErr net.Error
+	switch {
+	case err == sql.ErrNoRows:
+		*e = errorf(ErrNotFound, "task %q not found", name)
+	case strings.Contains(msg, "UNIQUE constraint failed"), strings.Contains(msg, "duplicate key value"):
+		*e = errorf(ErrConflict, "task %q already exists", name)
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr), strings.Contains(msg, "database is locked"):
+		*e = errorf(ErrUnavailable, "sql: %s", err)
+	}
+}
+
+// tx runs fn in a transaction. name is the task the operation is on.
+func (s *sqlBackend) tx(ctx context.Context, name string, fn func(tx *sql.Tx) error) (err error) {
+	defer sqlError(&err, name)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+//
+// rows
+//
+
+func (s *sqlBackend) load(ctx context.Context, tx *sql.Tx, name string) (task *Task, err error) {
+	task = &Task{Name: name}
+	err = tx.QueryRowContext(ctx, s.q(`SELECT description, revision, estimate, actual FROM est_tasks WHERE ns = ? AND name = ?`), s.ns, name).
+		Scan(&task.Description, &task.Revision, &task.Estimate, &task.Actual)
+	if err == sql.ErrNoRows {
+		err = errorf(ErrNotFound, "task %q not found", name)
+	}
+	if err != nil {
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, s.q(`SELECT at, estimate_delta, actual_delta, focus FROM est_annotations WHERE ns = ? AND name = ? ORDER BY seq`), s.ns, name)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var at int64
+		var a Annotation
+		if err = rows.Scan(&at, &a.EstimateDelta, &a.ActualDelta, &a.Focus); err != nil {
+			return
+		}
+		a.When = time.Unix(0, at)
+		task.Annotations = append(task.Annotations, a)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqlBackend) insertAnnotation(ctx context.Context, tx *sql.Tx, name string, seq int, a Annotation) (err error) {
+	_, err = tx.ExecContext(ctx, s.q(`INSERT INTO est_annotations (ns, name, seq, at, estimate_delta, actual_delta, focus) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		s.ns, name, seq, unixNanos(a.When), int64(a.EstimateDelta), int64(a.ActualDelta), a.Focus)
+	return
+}
+
+// update runs a change on the task row only if it is still at the revision
+// it was loaded at, and moves it to the next one.
+func (s *sqlBackend) update(ctx context.Context, tx *sql.Tx, task *Task, set string, args ...interface{}) (err error) {
+	args = append(args, s.ns, task.Name, task.Revision)
+	res, err := tx.ExecContext(ctx, s.q(`UPDATE est_tasks SET `+set+`, revision = revision + 1 WHERE ns = ? AND name = ? AND revision = ?`), args...)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return
+	}
+
+	//tell a task that changed apart from one that is gone
+	var count int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT COUNT(*) FROM est_tasks WHERE ns = ? AND name = ?`), s.ns, task.Name).Scan(&count)
+	if err == nil {
+		err = errorf(ErrNotFound, "task %q not found", task.Name)
+		if count > 0 {
+			err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+		}
+	}
+	return
+}
+
+//
+// Backend
+//
+
+func (s *sqlBackend) Save(ctx context.Context, task *Task) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, task.Name, func(tx *sql.Tx) (err error) {
+			//while theres a task with this name, increment the number on the end of it
+			candidate := task.Name
+			for i := 1; ; i++ {
+				var n int
+				err = tx.QueryRowContext(ctx, s.q(`SELECT COUNT(*) FROM est_tasks WHERE ns = ? AND name = ?`), s.ns, candidate).Scan(&n)
+				if err != nil {
+					return
+				}
+				if n == 0 {
+					break
+				}
+				candidate = fmt.Sprintf("%s%d", task.Name, i)
+			}
+
+			_, err = tx.ExecContext(ctx, s.q(`INSERT INTO est_tasks (ns, name, description, revision, estimate, actual) VALUES (?, ?, ?, ?, ?, ?)`),
+				s.ns, candidate, task.Description, task.Revision, int64(task.Estimate), int64(task.Actual))
+			if err != nil {
+				return
+			}
+			for i, a := range task.Annotations {
+				if err = s.insertAnnotation(ctx, tx, candidate, i, a); err != nil {
+					return
+				}
+			}
+			task.Name = candidate
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) SetDescription(ctx context.Context, task *Task, desc string) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, task.Name, func(tx *sql.Tx) error {
+			return s.update(ctx, tx, task, `description = ?`, desc)
+		})
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (s *sqlBackend) AddAnnotation(ctx context.Context, task *Task, a Annotation) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, task.Name, func(tx *sql.Tx) (err error) {
+			err = s.update(ctx, tx, task, `estimate = estimate + ?, actual = actual + ?`, int64(a.EstimateDelta), int64(a.ActualDelta))
+			if err != nil {
+				return
+			}
+			return s.appendAnnotation(ctx, tx, task.Name, a)
+		})
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (s *sqlBackend) appendAnnotation(ctx context.Context, tx *sql.Tx, name string, a Annotation) (err error) {
+	var seq int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT COALESCE(MAX(seq) + 1, 0) FROM est_annotations WHERE ns = ? AND name = ?`), s.ns, name).Scan(&seq)
+	if err != nil {
+		return
+	}
+	return s.insertAnnotation(ctx, tx, name, seq, a)
+}
+
+func (s *sqlBackend) PopAnnotation(ctx context.Context, task *Task) (err error) {
+	if len(task.Annotations) == 0 {
+		err = errorf(ErrInvalidArgument, "no annotations to undo")
+		return
+	}
+
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, task.Name, func(tx *sql.Tx) (err error) {
+			//take the deltas from the stored annotation. the revision check
+			//makes sure it is the one the caller saw last.
+			var seq int
+			var estimate, actual int64
+			err = tx.QueryRowContext(ctx, s.q(`SELECT seq, estimate_delta, actual_delta FROM est_annotations WHERE ns = ? AND name = ? ORDER BY seq DESC LIMIT 1`), s.ns, task.Name).
+				Scan(&seq, &estimate, &actual)
+			if err == sql.ErrNoRows {
+				err = errorf(ErrConflict, "task %q was changed since it was loaded", task.Name)
+			}
+			if err != nil {
+				return
+			}
+
+			if err = s.update(ctx, tx, task, `estimate = estimate - ?, actual = actual - ?`, estimate, actual); err != nil {
+				return
+			}
+			_, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_annotations WHERE ns = ? AND name = ? AND seq = ?`), s.ns, task.Name, seq)
+			return
+		})
+	})
+	if err == nil {
+		task.Revision++
+	}
+	return
+}
+
+func (s *sqlBackend) Load(ctx context.Context, name string) (task *Task, err error) {
+	err = s.conf.retry(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, name, func(tx *sql.Tx) (err error) {
+			task, err = s.load(ctx, tx, name)
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) Start(ctx context.Context, name string) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, name, func(tx *sql.Tx) (err error) {
+			if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_timers WHERE ns = ?`), s.ns); err != nil {
+				return
+			}
+			_, err = tx.ExecContext(ctx, s.q(`INSERT INTO est_timers (ns, name, started) VALUES (?, ?, ?)`), s.ns, name, time.Now().UnixNano())
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) Stop(ctx context.Context) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+			_, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_timers WHERE ns = ?`), s.ns)
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) status(ctx context.Context, tx *sql.Tx) (log *StartLog, err error) {
+	var started int64
+	log = new(StartLog)
+	err = tx.QueryRowContext(ctx, s.q(`SELECT name, started FROM est_timers WHERE ns = ?`), s.ns).Scan(&log.Name, &started)
+	if err == sql.ErrNoRows {
+		log, err = nil, nil
+		return
+	}
+	log.When = time.Unix(0, started)
+	return
+}
+
+// StopTimer removes the timer and records the time in one transaction. only
+// the stop that deletes the timer row records it.
+func (s *sqlBackend) StopTimer(ctx context.Context, when time.Time) (log *StartLog, task *Task, err error) {
+	var missing bool
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+			log, task, missing = nil, nil, false
+			l, err := s.status(ctx, tx)
+			if err != nil || l == nil {
+				return
+			}
+			res, err := tx.ExecContext(ctx, s.q(`DELETE FROM est_timers WHERE ns = ? AND started = ?`), s.ns, unixNanos(l.When))
+			if err != nil {
+				return
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				//another stop got there first
+				return err
+			}
+
+			a := l.Annotation(when)
+			log = l
+			res, err = tx.ExecContext(ctx, s.q(`UPDATE est_tasks SET actual = actual + ?, revision = revision + 1 WHERE ns = ? AND name = ?`), int64(a.ActualDelta), s.ns, l.Name)
+			if err != nil {
+				return
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				//the task is gone. still stop the timer.
+				missing = err == nil
+				return err
+			}
+			if err = s.appendAnnotation(ctx, tx, l.Name, a); err != nil {
+				return
+			}
+			task, err = s.load(ctx, tx, l.Name)
+			return
+		})
+	})
+	if err == nil && missing {
+		err = errorf(ErrNotFound, "task %q not found", log.Name)
+	}
+	return
+}
+
+func (s *sqlBackend) Status(ctx context.Context) (log *StartLog, err error) {
+	err = s.conf.retry(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+			log, err = s.status(ctx, tx)
+			return
+		})
+	})
+	return
+}
+
+// Find narrows the tasks down by the annotation time index in the database
+// and by the regex in go, since the databases disagree on regex syntax.
+func (s *sqlBackend) Find(ctx context.Context, regex string, before, after time.Time) (tasks []*Task, err error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		err = errorf(ErrInvalidArgument, "invalid regex: %s", err)
+		return
+	}
+
+	err = s.conf.retry(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+			tasks = nil
+			query, args := `SELECT DISTINCT name FROM est_annotations WHERE ns = ? AND at >= ? AND at < ? ORDER BY name`, []interface{}{s.ns, unixNanos(before), unixNanos(after)}
+			if findsAll(before, after) {
+				query, args = `SELECT name FROM est_tasks WHERE ns = ? ORDER BY name`, []interface{}{s.ns}
+			}
+			rows, err := tx.QueryContext(ctx, s.q(query), args...)
+			if err != nil {
+				return
+			}
+			var names []string
+			for rows.Next() {
+				var name string
+				if err = rows.Scan(&name); err != nil {
+					rows.Close()
+					return
+				}
+				if re.MatchString(name) {
+					names = append(names, name)
+				}
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return
+			}
+
+			for _, name := range names {
+				var task *Task
+				if task, err = s.load(ctx, tx, name); err != nil {
+					return
+				}
+				tasks = append(tasks, task)
+			}
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) Rename(ctx context.Context, oldn, newn string) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, oldn, func(tx *sql.Tx) (err error) {
+			var n int
+			err = tx.QueryRowContext(ctx, s.q(`SELECT COUNT(*) FROM est_tasks WHERE ns = ? AND name = ?`), s.ns, newn).Scan(&n)
+			if err != nil {
+				return
+			}
+			if n > 0 {
+				return errorf(ErrConflict, "task %q already exists", newn)
+			}
+
+			res, err := tx.ExecContext(ctx, s.q(`UPDATE est_tasks SET name = ? WHERE ns = ? AND name = ?`), newn, s.ns, oldn)
+			if err != nil {
+				return
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				if err == nil {
+					err = errorf(ErrNotFound, "task %q not found", oldn)
+				}
+				return err
+			}
+			_, err = tx.ExecContext(ctx, s.q(`UPDATE est_annotations SET name = ? WHERE ns = ? AND name = ?`), newn, s.ns, oldn)
+			return
+		})
+	})
+	return
+}
+
+func (s *sqlBackend) Remove(ctx context.Context, name string) (err error) {
+	err = s.conf.call(ctx, func(ctx context.Context) error {
+		return s.tx(ctx, name, func(tx *sql.Tx) (err error) {
+			if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_annotations WHERE ns = ? AND name = ?`), s.ns, name); err != nil {
+				return
+			}
+			_, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_tasks WHERE ns = ? AND name = ?`), s.ns, name)
+			return
+		})
+	})
+	return
+}
+
+//
+// schema versions
+//
+
+// addColumns runs the sqlColumns the database hasn't had. it runs before
+// stampSchema, so a database without a schema version is new.
+func (s *sqlBackend) addColumns(ctx context.Context, tx *sql.Tx) (err error) {
+	var n int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT COUNT(*) FROM est_meta WHERE name = 'schema'`)).Scan(&n)
+	if err != nil {
+		return
+	}
+	done := len(sqlColumns)
+	if n > 0 {
+		var value string
+		err = tx.QueryRowContext(ctx, s.q(`SELECT value FROM est_meta WHERE name = 'columns'`)).Scan(&value)
+		switch {
+		case err == sql.ErrNoRows:
+			done, err = 0, nil
+		case err == nil:
+			done, err = strconv.Atoi(value)
+		}
+		if err != nil || done >= len(sqlColumns) {
+			return
+		}
+	}
+
+	for _, stmt := range sqlColumns[done:] {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return
+		}
+	}
+	if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_meta WHERE name = 'columns'`)); err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx, s.q(`INSERT INTO est_meta (name, value) VALUES ('columns', ?)`), strconv.Itoa(len(sqlColumns)))
+	return
+}
+
+// stampSchema records the current version in a new database. est had
+// schema versions before this backend, so any existing data is current.
+func (s *sqlBackend) stampSchema(ctx context.Context, tx *sql.Tx) (err error) {
+	var n int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT COUNT(*) FROM est_meta WHERE name = 'schema'`)).Scan(&n)
+	if err != nil || n > 0 {
+		return
+	}
+	_, err = tx.ExecContext(ctx, s.q(`INSERT INTO est_meta (name, value) VALUES ('schema', ?)`), strconv.Itoa(currentSchema()))
+	return
+}
+
+func (s *sqlBackend) schema(ctx context.Context) (version int, err error) {
+	err = s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+		var value string
+		err = tx.QueryRowContext(ctx, s.q(`SELECT value FROM est_meta WHERE name = 'schema'`)).Scan(&value)
+		if err != nil {
+			return
+		}
+		version, err = strconv.Atoi(value)
+		return
+	})
+	return
+}
+
+// migrate hands every task of every user to the migration as a document with
+// the field names the bson encoding uses, and writes back what it changed.
+func (s *sqlBackend) migrate(ctx context.Context, m migration) (err error) {
+	err = s.tx(ctx, "", func(tx *sql.Tx) (err error) {
+		rows, err := tx.QueryContext(ctx, `SELECT ns, name FROM est_tasks`)
+		if err != nil {
+			return
+		}
+		var keys [][2]string
+		for rows.Next() {
+			var k [2]string
+			if err = rows.Scan(&k[0], &k[1]); err != nil {
+				rows.Close()
+				return
+			}
+			keys = append(keys, k)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return
+		}
+
+		for _, k := range keys {
+			ns := &sqlBackend{postgres: s.postgres, ns: k[0]}
+			if err = ns.migrateTask(ctx, tx, k[1], m); err != nil {
+				return
+			}
+		}
+		_, err = tx.ExecContext(ctx, s.q(`UPDATE est_meta SET value = ? WHERE name = 'schema'`), strconv.Itoa(m.version))
+		return
+	})
+	return
+}
+
+func (s *sqlBackend) migrateTask(ctx context.Context, tx *sql.Tx, name string, m migration) (err error) {
+	task, err := s.load(ctx, tx, name)
+	if err != nil {
+		return
+	}
+	var anns []interface{}
+	for _, a := range task.Annotations {
+		anns = append(anns, map[string]interface{}{
+			"when":          a.When,
+			"estimatedelta": int64(a.EstimateDelta),
+			"actualdelta":   int64(a.ActualDelta),
+			"focus":         a.Focus,
+		})
+	}
+	t := doc{
+		"description": task.Description,
+		"revision":    task.Revision,
+		"estimate":    int64(task.Estimate),
+		"actual":      int64(task.Actual),
+		"annotations": anns,
+	}
+	if err = m.task(t); err != nil {
+		return
+	}
+
+	desc, _ := t.get("description").(string)
+	_, err = tx.ExecContext(ctx, s.q(`UPDATE est_tasks SET description = ?, revision = ?, estimate = ?, actual = ? WHERE ns = ? AND name = ?`),
+		desc, docInt(t.get("revision")), docInt(t.get("estimate")), docInt(t.get("actual")), s.ns, name)
+	if err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM est_annotations WHERE ns = ? AND name = ?`), s.ns, name); err != nil {
+		return
+	}
+	for i, a := range t.list("annotations") {
+		when, _ := a.get("when").(time.Time)
+		err = s.insertAnnotation(ctx, tx, name, i, Annotation{
+			When:          when,
+			EstimateDelta: time.Duration(docInt(a.get("estimatedelta"))),
+			ActualDelta:   time.Duration(docInt(a.get("actualdelta"))),
+			Focus:         a.get("focus") == true,
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
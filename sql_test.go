@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLite(t *testing.T) {
+	b, err := openSQL(&SQLConfig{DSN: filepath.Join(t.TempDir(), "est.sqlite")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+// TestPostgres needs an empty database, named by a dsn in EST_TEST_POSTGRES.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("EST_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("set EST_TEST_POSTGRES to test against postgres")
+	}
+	b, err := openSQL(&SQLConfig{Driver: "postgres", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+func TestSQLiteAddsFocusColumn(t *testing.T) {
+	ctx := context.Background()
+	c := &SQLConfig{DSN: filepath.Join(t.TempDir(), "est.sqlite")}
+	b, err := openSQL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSave(t, b, "old")
+
+	//a database from before focus sessions
+	s := b.(*sqlBackend)
+	for _, stmt := range []string{
+		`ALTER TABLE est_annotations DROP COLUMN focus`,
+		`DELETE FROM est_meta WHERE name = 'columns'`,
+	} {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.db.Close()
+
+	//opening it adds the column, without asking for an upgrade
+	if b, err = openSQL(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema(ctx, b.(*sqlBackend)); err != nil {
+		t.Fatal(err)
+	}
+	task, err := b.Load(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddAnnotation(ctx, task, Annotation{When: testNow, ActualDelta: time.Minute, Focus: true}); err != nil {
+		t.Fatal(err)
+	}
+	if task, err = b.Load(ctx, "old"); err != nil || task.Sessions() != 1 {
+		t.Fatalf("%v sessions after adding the column, %v", task, err)
+	}
+	b.(*sqlBackend).db.Close()
+
+	//and only once
+	if b, err = openSQL(c); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"time"
 )
 
 func init() {
@@ -16,6 +16,8 @@ func init() {
 
 		flags: flag.NewFlagSet("start", flag.ExitOnError),
 		run:   start,
+
+		complete: taskArgs(1),
 	}
 
 	commands["start"] = cmd
@@ -27,14 +29,14 @@ func start(c *command) {
 		c.Usage(1)
 	}
 
-	if err := stopIfStarted(); err != nil {
+	task, err := loadTask(c.ctx, args[0])
+	if err != nil {
 		c.Error(err)
 	}
-	task, err := defaultBackend.Load(args[0])
-	if err != nil {
+	if err := stopIfStarted(c.ctx); err != nil {
 		c.Error(err)
 	}
-	if err := defaultBackend.Start(task.Name); err != nil {
+	if err := defaultBackend.Start(c.ctx, task.Name); err != nil {
 		c.Error(err)
 	}
 
@@ -42,31 +44,13 @@ func start(c *command) {
 	fmt.Println(task)
 }
 
-func stopIfStarted() (err error) {
-	log, err := defaultBackend.Status()
-	if err != nil {
-		return
-	}
-	if log == nil {
+func stopIfStarted(ctx context.Context) (err error) {
+	log, task, err := stopRunning(ctx)
+	if err != nil || log == nil {
 		return
 	}
+	ann := task.Annotations[len(task.Annotations)-1]
 	fmt.Println("already working on", log.Name)
-	if err = defaultBackend.Stop(); err != nil {
-		return
-	}
-	dur := time.Since(log.When)
-	fmt.Println("adding", dur, "to", log.Name)
-
-	ann := Annotation{
-		When:        time.Now(),
-		ActualDelta: dur,
-	}
-	task, err := defaultBackend.Load(log.Name)
-	if err != nil {
-		return
-	}
-	if err = defaultBackend.AddAnnotation(task, ann); err != nil {
-		return
-	}
+	fmt.Println("adding", ann.ActualDelta, "to", log.Name)
 	return
 }
@@ -27,7 +27,7 @@ func status(c *command) {
 		c.Usage(1)
 	}
 
-	log, err := defaultBackend.Status()
+	log, err := defaultBackend.Status(c.ctx)
 	if err != nil {
 		c.Error(err)
 	}
@@ -36,11 +36,15 @@ func status(c *command) {
 		return
 	}
 
-	task, err := defaultBackend.Load(log.Name)
+	task, err := defaultBackend.Load(c.ctx, log.Name)
 	if err != nil {
 		c.Error(err)
 	}
 
 	fmt.Printf("working on %s since %s (%s)\n", task.Name, log.When, time.Since(log.When))
 	fmt.Println(task)
+
+	if reason, _ := timerConfig().suspect(log, time.Now()); reason != "" {
+		fmt.Printf("warning: the timer has been %s\n", reason)
+	}
 }
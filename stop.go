@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"time"
 )
 
 func init() {
@@ -29,7 +28,7 @@ func stop(c *command) {
 		c.Usage(0)
 	}
 
-	log, err := defaultBackend.Status()
+	log, task, err := stopRunning(c.ctx)
 	if err != nil {
 		c.Error(err)
 	}
@@ -38,26 +37,7 @@ func stop(c *command) {
 		os.Exit(1)
 	}
 
-	if err := defaultBackend.Stop(); err != nil {
-		c.Error(err)
-	}
-
-	dur := time.Since(log.When)
-	fmt.Println("adding", dur, "to", log.Name)
-
-	task, err := defaultBackend.Load(log.Name)
-	if err != nil {
-		c.Error(err)
-	}
-
-	ann := Annotation{
-		When:        time.Now(),
-		ActualDelta: dur,
-	}
-	if err := defaultBackend.AddAnnotation(task, ann); err != nil {
-		c.Error(err)
-	}
-
-	task.Apply(ann)
+	ann := task.Annotations[len(task.Annotations)-1]
+	fmt.Println("adding", ann.ActualDelta, "to", log.Name)
 	fmt.Println(task)
 }
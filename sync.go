@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func init() {
+	cmd := &command{
+		short: "sends changes made offline to the backend",
+		long:  "Sends the changes queued while the backend was unreachable, in the order they were made. A change to a task that was also changed elsewhere is a conflict, and stops the sync until it's applied anyway with -force or dropped with -skip.",
+		usage: "sync [-list] [-force | -skip]",
+
+		needsBackend: true,
+
+		flags: flag.NewFlagSet("sync", flag.ExitOnError),
+		run:   syncQueue,
+	}
+
+	cmd.flags.BoolVar(&syncParams.list, "list", false, "list the queued changes without sending them")
+	cmd.flags.BoolVar(&syncParams.force, "force", false, "apply changes that conflict with changes made elsewhere")
+	cmd.flags.BoolVar(&syncParams.skip, "skip", false, "drop changes that conflict with changes made elsewhere")
+
+	commands["sync"] = cmd
+}
+
+var syncParams struct {
+	list  bool
+	force bool
+	skip  bool
+}
+
+func syncQueue(c *command) {
+	args := c.flags.Args()
+	if len(args) != 0 || (syncParams.force && syncParams.skip) {
+		c.Usage(1)
+	}
+
+	o, ok := defaultBackend.(*offlineBackend)
+	if !ok {
+		c.Error(errorf(ErrInvalidArgument, "offline mode is not configured"))
+	}
+
+	if syncParams.list {
+		for _, op := range o.state.Queue {
+			fmt.Println(op)
+		}
+		return
+	}
+
+	if len(o.state.Queue) == 0 {
+		fmt.Println("nothing to sync")
+		return
+	}
+
+	err := o.sync(c.ctx, syncParams.force, syncParams.skip, func(op offlineOp, result string) {
+		fmt.Printf("%s (%s)\n", op, result)
+	})
+	if err != nil {
+		if isCode(err, ErrConflict) {
+			fmt.Printf("%d changes still queued. use -force to apply them anyway or -skip to drop the conflicting ones\n", len(o.state.Queue))
+		}
+		c.Error(err)
+	}
+}
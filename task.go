@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -10,9 +11,31 @@ type StartLog struct {
 	When time.Time
 }
 
+// Annotation is the annotation recording the time spent on the task if the
+// timer is stopped at when.
+func (l StartLog) Annotation(when time.Time) Annotation {
+	return Annotation{
+		When:        when,
+		ActualDelta: when.Sub(l.When),
+	}
+}
+
+// unixNanos is t.UnixNano clamped to the times it can represent, for
+// backends that store times as numbers.
+func unixNanos(t time.Time) int64 {
+	switch {
+	case t.Before(time.Unix(0, math.MinInt64)):
+		return math.MinInt64
+	case t.After(time.Unix(0, math.MaxInt64)):
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
 type Task struct {
 	Name        string
 	Description string `json:",omitempty" xml:",omitempty" bson:",omitempty"`
+	Revision    int64  `json:",omitempty" xml:",omitempty" bson:",omitempty"` //counts changes. mutations fail if it moved since the task was loaded
 	logName     string
 
 	Estimate     time.Duration
@@ -25,6 +48,7 @@ type Annotation struct {
 	When          time.Time
 	EstimateDelta time.Duration `json:",omitempty" xml:",omitempty" bson:",omitempty"`
 	ActualDelta   time.Duration `json:",omitempty" xml:",omitempty" bson:",omitempty"`
+	Focus         bool          `json:",omitempty" xml:",omitempty" bson:",omitempty"` //the time is a completed focus session
 }
 
 func (a Annotation) Negate() Annotation {
@@ -32,6 +56,7 @@ func (a Annotation) Negate() Annotation {
 		When:          a.When,
 		EstimateDelta: -1 * a.EstimateDelta,
 		ActualDelta:   -1 * a.ActualDelta,
+		Focus:         a.Focus,
 	}
 }
 
@@ -39,6 +64,9 @@ func (a Annotation) DeltaString() string {
 	if a.EstimateDelta != 0 {
 		return fmt.Sprintf("Estimate: %s", a.EstimateDelta)
 	}
+	if a.Focus {
+		return fmt.Sprintf("Actual: %s (focus)", a.ActualDelta)
+	}
 	return fmt.Sprintf("Actual: %s", a.ActualDelta)
 }
 
@@ -108,22 +136,56 @@ func (t Task) MatchedActual() (x time.Duration) {
 	return
 }
 
+// Sessions counts the completed focus sessions on the task.
+func (t Task) Sessions() int {
+	return countSessions(t.Annotations)
+}
+
+func (t Task) MatchedSessions() int {
+	return countSessions(t.matchedAnnos)
+}
+
+// countSessions counts focus annotations. a negated one only takes its time
+// back off the totals, since undo removes the session it negates.
+func countSessions(annos []Annotation) (n int) {
+	for _, a := range annos {
+		if a.Focus && a.ActualDelta > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// sessionString describes a count of focus sessions, or nothing if there
+// weren't any.
+func sessionString(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return " 1 session"
+	}
+	return fmt.Sprintf(" %d sessions", n)
+}
+
 func (t Task) MatchedString() string {
-	return fmt.Sprintf("%s: %s / %s (%0.2f)%s",
+	return fmt.Sprintf("%s: %s / %s (%0.2f)%s%s",
 		t.Name,
 		t.MatchedActual(),
 		t.MatchedEstimate(),
 		t.MatchedRatio(),
+		sessionString(t.MatchedSessions()),
 		wrap(t.Description, "\n", 80),
 	)
 }
 
 func (t Task) String() string {
-	return fmt.Sprintf("%s: %s / %s (%0.2f)%s",
+	return fmt.Sprintf("%s: %s / %s (%0.2f)%s%s",
 		t.Name,
 		t.Actual,
 		t.Estimate,
 		t.Ratio(),
+		sessionString(t.Sessions()),
 		wrap(t.Description, "\n", 80),
 	)
 }
@@ -133,21 +195,23 @@ func (t Task) LogName() string {
 }
 
 func (t Task) MatchedPretty() string {
-	return fmt.Sprintf("\033[1m%s%s / %s (%0.2f)\033[0m%s",
+	return fmt.Sprintf("\033[1m%s%s / %s (%0.2f)%s\033[0m%s",
 		t.logName,
 		t.MatchedActual(),
 		t.MatchedEstimate(),
 		t.MatchedRatio(),
+		sessionString(t.MatchedSessions()),
 		wrap(t.Description, "\n", 80),
 	)
 }
 
 func (t Task) Pretty() string {
-	return fmt.Sprintf("\033[1m%s%s / %s (%0.2f)\033[0m%s",
+	return fmt.Sprintf("\033[1m%s%s / %s (%0.2f)%s\033[0m%s",
 		t.logName,
 		t.Actual,
 		t.Estimate,
 		t.Ratio(),
+		sessionString(t.Sessions()),
 		wrap(t.Description, "\n", 80),
 	)
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUndoFocusSession(t *testing.T) {
+	task := &Task{Name: "a"}
+	task.Apply(Annotation{When: testNow, ActualDelta: 25 * time.Minute, Focus: true})
+	task.Apply(Annotation{When: testNow, ActualDelta: 25 * time.Minute, Focus: true})
+	if n := task.Sessions(); n != 2 {
+		t.Fatalf("%d sessions", n)
+	}
+
+	//as undo does it
+	anno := task.Annotations[len(task.Annotations)-1]
+	task.Annotations = task.Annotations[:len(task.Annotations)-1]
+	task.Apply(anno.Negate())
+	if n := task.Sessions(); n != 1 || task.Actual != 25*time.Minute {
+		t.Fatalf("%d sessions and %s after undoing one", n, task.Actual)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// loadCertPool reads a file of pem encoded certificates into a pool.
+func loadCertPool(path string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		err = fmt.Errorf("%s: no certificates found", path)
+	}
+	return
+}
+
+// clientTLSConfig returns the tls configuration for connecting to serve, or
+// nil if the connection should be in the clear.
+func clientTLSConfig(c *RPCConfig) (conf *tls.Config, err error) {
+	if !c.TLS && c.CA == "" && c.Cert == "" && c.Key == "" {
+		return
+	}
+
+	conf = &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if conf.ServerName == "" {
+		host, _, herr := net.SplitHostPort(c.Address)
+		if herr != nil {
+			host = c.Address
+		}
+		conf.ServerName = host
+	}
+
+	//use the system roots unless a ca is given
+	if c.CA != "" {
+		if conf.RootCAs, err = loadCertPool(c.CA); err != nil {
+			return
+		}
+	}
+
+	//present a client certificate if the server verifies them
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			err = fmt.Errorf("both Cert and Key are required for a client certificate")
+			return
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(c.Cert, c.Key); err != nil {
+			return
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// serverTLSConfig returns the tls configuration for serve. if clientCA is
+// given, clients must present a certificate signed by it.
+func serverTLSConfig(cert, key, clientCA string) (conf *tls.Config, err error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return
+	}
+	conf = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		if conf.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts writes a ca with a server certificate for localhost and a client
+// certificate signed by it into dir, as <name>.pem and <name>.key.
+func testCerts(t *testing.T, dir string) {
+	caKey := testKey(t, dir, "ca")
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "est test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca = testCert(t, dir, "ca", ca, ca, caKey, caKey)
+
+	testCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, testKey(t, dir, "server"), caKey)
+
+	testCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, testKey(t, dir, "client"), caKey)
+}
+
+func testKey(t *testing.T, dir, name string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testCert(t *testing.T, dir, name string, tmpl, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testServeTLS serves rpc over tls on a local port, asking for client
+// certificates signed by the ca.
+func testServeTLS(t *testing.T, dir string) (address string) {
+	b, err := openBolt(&BoltConfig{Path: filepath.Join(dir, "est.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultBackend = b
+
+	p := func(name string) string { return filepath.Join(dir, name) }
+	conf, err := serverTLSConfig(p("server.pem"), p("server.key"), p("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{TLSConfig: conf}
+	go srv.ServeTLS(l, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	testCerts(t, dir)
+	address := testServeTLS(t, dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	b, err := openRPC(&RPCConfig{
+		Network:    "tcp",
+		Address:    address,
+		CA:         p("ca.pem"),
+		ServerName: "localhost",
+		Cert:       p("client.pem"),
+		Key:        p("client.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(context.Background(), &Task{Name: "tls"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Load(context.Background(), "tls"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSRejected(t *testing.T) {
+	dir := t.TempDir()
+	testCerts(t, dir)
+	address := testServeTLS(t, dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	for _, test := range []struct {
+		name string
+		conf RPCConfig
+	}{
+		{"no client certificate", RPCConfig{CA: p("ca.pem"), ServerName: "localhost"}},
+		{"server not trusted", RPCConfig{TLS: true, ServerName: "localhost", Cert: p("client.pem"), Key: p("client.key")}},
+		{"wrong server name", RPCConfig{CA: p("ca.pem"), ServerName: "example.com", Cert: p("client.pem"), Key: p("client.key")}},
+		{"plaintext", RPCConfig{}},
+	} {
+		c := test.conf
+		c.Network, c.Address = "tcp", address
+		c.DialTimeout = Duration(2 * time.Second)
+		if _, err := openRPC(&c); err == nil {
+			t.Errorf("%s: connected", test.name)
+		}
+	}
+}
+
+func TestTLSCertAndKeyTogether(t *testing.T) {
+	for _, c := range []RPCConfig{
+		{Network: "tcp", Address: "localhost:1", Key: "client.key"},
+		{Network: "tcp", Address: "localhost:1", Cert: "client.pem"},
+	} {
+		if _, err := clientTLSConfig(&c); err == nil {
+			t.Errorf("%+v: no error setting up tls", c)
+		}
+		problems := c.validate()
+		if len(problems) != 1 || !strings.Contains(problems[0], "Cert and Key") {
+			t.Errorf("%+v: problems %q", c, problems)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+func init() {
+	cmd := &command{
+		short: "opens a full screen view of today's tasks and the timer",
+		long:  "Shows the timer and the tasks worked on today with how much of their estimates was spent, and keeps it up to date. Move with j and k or the arrow keys, start the selected task with enter or s, stop the timer with x, add time with a, add to the estimate with e, change the description with d, reload with r and quit with q.",
+		usage: "ui [-refresh=]",
+
+		needsBackend: true,
+
+		flags: flag.NewFlagSet("ui", flag.ExitOnError),
+		run:   ui,
+	}
+
+	cmd.flags.DurationVar(&uiParams.refresh, "refresh", 30*time.Second, "how often to reload the tasks from the backend")
+
+	commands["ui"] = cmd
+}
+
+var uiParams struct {
+	refresh time.Duration
+}
+
+const uiHelp = "enter start  x stop  a add time  e add estimate  d describe  r reload  q quit"
+
+// uiPrompt is a line being typed at the bottom of the screen.
+type uiPrompt struct {
+	label string
+	text  string
+	done  func(text string)
+}
+
+type uiState struct {
+	c *command
+
+	tasks    []*Task
+	log      *StartLog
+	selected string //name of the task under the cursor
+	msg      string
+	prompt   *uiPrompt
+	loaded   time.Time
+}
+
+func ui(c *command) {
+	args := c.flags.Args()
+	if len(args) != 0 {
+		c.Usage(1)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		c.Error(errorf(ErrInvalidArgument, "est ui needs a terminal"))
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		c.Error(err)
+	}
+
+	//use the alternate screen so the shell comes back as it was
+	fmt.Print("\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		term.Restore(fd, old)
+	}()
+
+	keys := make(chan string)
+	go uiReadKeys(keys)
+
+	s := &uiState{c: c}
+	s.reload()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		if time.Since(s.loaded) >= uiParams.refresh {
+			s.reload()
+		}
+		s.draw()
+
+		select {
+		case <-tick.C:
+		case key, ok := <-keys:
+			if !ok || !s.handle(key) {
+				return
+			}
+		}
+	}
+}
+
+// uiReadKeys sends each key pressed, naming the ones that aren't printable.
+func uiReadKeys(keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 32)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		in := buf[:n]
+		for len(in) > 0 {
+			key, size := "", 1
+			switch {
+			case bytes.HasPrefix(in, []byte("\033[A")), bytes.HasPrefix(in, []byte("\033OA")):
+				key, size = "up", 3
+			case bytes.HasPrefix(in, []byte("\033[B")), bytes.HasPrefix(in, []byte("\033OB")):
+				key, size = "down", 3
+			case in[0] == '\033':
+				key, size = "esc", len(in) //drop whatever sequence follows
+			case in[0] == '\r' || in[0] == '\n':
+				key = "enter"
+			case in[0] == 127 || in[0] == 8:
+				key = "backspace"
+			case in[0] == 3 || in[0] == 4:
+				key = "quit"
+			default:
+				var r rune
+				r, size = utf8.DecodeRune(in)
+				key = string(r)
+			}
+			keys <- key
+			in = in[size:]
+		}
+	}
+}
+
+// reload fetches the timer and the tasks worked on today, along with the
+// running task even if it wasn't.
+func (s *uiState) reload() {
+	s.loaded = time.Now()
+	ctx := s.c.ctx
+
+	log, err := defaultBackend.Status(ctx)
+	if err != nil {
+		s.msg = err.Error()
+		return
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	tasks, err := defaultBackend.Find(ctx, "", today, today.AddDate(0, 0, 1))
+	if err != nil {
+		s.msg = err.Error()
+		return
+	}
+	sort.Sort(sortedTasks(tasks))
+
+	if log != nil && s.find(tasks, log.Name) < 0 {
+		task, err := defaultBackend.Load(ctx, log.Name)
+		if err != nil {
+			s.msg = err.Error()
+			return
+		}
+		tasks = append([]*Task{task}, tasks...)
+	}
+
+	s.log, s.tasks = log, tasks
+	if s.find(tasks, s.selected) < 0 && len(tasks) > 0 {
+		s.selected = tasks[0].Name
+	}
+}
+
+func (s *uiState) find(tasks []*Task, name string) int {
+	for i, t := range tasks {
+		if t.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *uiState) current() *Task {
+	if i := s.find(s.tasks, s.selected); i >= 0 {
+		return s.tasks[i]
+	}
+	return nil
+}
+
+// handle acts on a key, and tells if the ui should keep going.
+func (s *uiState) handle(key string) bool {
+	if p := s.prompt; p != nil {
+		switch key {
+		case "enter":
+			s.prompt = nil
+			p.done(strings.TrimSpace(p.text))
+		case "esc":
+			s.prompt = nil
+		case "backspace":
+			if _, size := utf8.DecodeLastRuneInString(p.text); size > 0 {
+				p.text = p.text[:len(p.text)-size]
+			}
+		case "quit":
+			return false
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				p.text += key
+			}
+		}
+		return true
+	}
+
+	s.msg = ""
+	i := s.find(s.tasks, s.selected)
+	task := s.current()
+	switch key {
+	case "q", "quit":
+		return false
+	case "up", "k":
+		if i > 0 {
+			s.selected = s.tasks[i-1].Name
+		}
+	case "down", "j":
+		if i >= 0 && i+1 < len(s.tasks) {
+			s.selected = s.tasks[i+1].Name
+		}
+	case "r":
+		s.reload()
+	case "enter", "s":
+		if task != nil {
+			s.start(task.Name)
+		}
+	case "x":
+		s.stop()
+	case "a", "e":
+		if task == nil {
+			break
+		}
+		maker, label := annoMaker(makeActualAnno), "add time to "+task.Name+": "
+		if key == "e" {
+			maker, label = makeEstimateAnno, "add estimate to "+task.Name+": "
+		}
+		s.prompt = &uiPrompt{label: label, done: func(text string) {
+			s.annotate(task.Name, text, maker)
+		}}
+	case "d":
+		if task == nil {
+			break
+		}
+		s.prompt = &uiPrompt{label: "description: ", text: task.Description, done: func(text string) {
+			s.describe(task.Name, text)
+		}}
+	}
+	return true
+}
+
+func (s *uiState) start(name string) {
+	ctx := s.c.ctx
+	log, stopped, err := defaultBackend.StopTimer(ctx, time.Now())
+	if err == nil {
+		err = defaultBackend.Start(ctx, name)
+	}
+	switch {
+	case err != nil:
+		s.msg = err.Error()
+	case log != nil:
+		ann := stopped.Annotations[len(stopped.Annotations)-1]
+		s.msg = fmt.Sprintf("added %s to %s. started %s", ann.ActualDelta, log.Name, name)
+	default:
+		s.msg = "started " + name
+	}
+	s.reload()
+}
+
+func (s *uiState) stop() {
+	log, task, err := defaultBackend.StopTimer(s.c.ctx, time.Now())
+	switch {
+	case err != nil:
+		s.msg = err.Error()
+	case log == nil:
+		s.msg = "not working on any task"
+	default:
+		ann := task.Annotations[len(task.Annotations)-1]
+		s.msg = fmt.Sprintf("added %s to %s", ann.ActualDelta, log.Name)
+	}
+	s.reload()
+}
+
+func (s *uiState) annotate(name, text string, maker annoMaker) {
+	dur, err := time.ParseDuration(text)
+	if err != nil {
+		s.msg = err.Error()
+		return
+	}
+	task, err := defaultBackend.Load(s.c.ctx, name)
+	if err == nil {
+		ann := maker(time.Now(), dur)
+		if err = defaultBackend.AddAnnotation(s.c.ctx, task, ann); err == nil {
+			s.msg = fmt.Sprintf("%s: %s", name, ann.DeltaString())
+		}
+	}
+	if err != nil {
+		s.msg = err.Error()
+	}
+	s.reload()
+}
+
+func (s *uiState) describe(name, desc string) {
+	task, err := defaultBackend.Load(s.c.ctx, name)
+	if err == nil {
+		err = defaultBackend.SetDescription(s.c.ctx, task, desc)
+	}
+	if err != nil {
+		s.msg = err.Error()
+	} else {
+		s.msg = "description updated"
+	}
+	s.reload()
+}
+
+// draw writes the whole screen. in raw mode lines end with \r\n.
+func (s *uiState) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	now := time.Now()
+	lines = append(lines, "\033[1mest\033[0m  "+now.Format("Mon Jan 2 15:04:05"), "")
+
+	running := time.Duration(0)
+	if s.log != nil {
+		running = now.Sub(s.log.When).Truncate(time.Second)
+		lines = append(lines, fmt.Sprintf("working on \033[1m%s\033[0m for %s", s.log.Name, running))
+	} else {
+		lines = append(lines, "not working on any task")
+	}
+	lines = append(lines, "")
+
+	nameWidth := 0
+	for _, t := range s.tasks {
+		if n := utf8.RuneCountInString(t.Name); n > nameWidth {
+			nameWidth = n
+		}
+	}
+	if len(s.tasks) == 0 {
+		lines = append(lines, "no tasks worked on today")
+	}
+	for _, t := range s.tasks {
+		actual := t.Actual
+		if s.log != nil && s.log.Name == t.Name {
+			actual += running
+		}
+		line := fmt.Sprintf("%-*s %s %s / %s", nameWidth, t.Name, uiBar(actual, t.Estimate, 20), actual.Round(time.Second), t.Estimate)
+		if t.Name == s.selected {
+			line = "\033[7m> " + line + "\033[0m"
+		} else {
+			line = "  " + line
+		}
+		lines = append(lines, line)
+	}
+
+	if task := s.current(); task != nil && task.Description != "" {
+		lines = append(lines, "", task.Description)
+	}
+
+	//the help, message and prompt sit at the bottom
+	bottom := []string{"", uiHelp, s.msg}
+	if s.prompt != nil {
+		bottom[2] = s.prompt.label + s.prompt.text
+	}
+	for len(lines)+len(bottom) < height {
+		lines = append(lines, "")
+	}
+	if keep := height - len(bottom); keep >= 0 {
+		lines = append(lines[:keep], bottom...)
+	}
+
+	var buf strings.Builder
+	buf.WriteString("\033[H")
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(uiClip(line, width))
+		buf.WriteString("\033[K")
+	}
+	os.Stdout.WriteString(buf.String())
+}
+
+// uiBar draws how much of the estimate was spent. time past the estimate
+// turns the bar red.
+func uiBar(actual, estimate time.Duration, width int) string {
+	filled := 0
+	switch {
+	case actual >= estimate && actual > 0:
+		filled = width
+	case estimate > 0:
+		filled = int(int64(width) * int64(actual) / int64(estimate))
+	}
+	color := "\033[32m"
+	if actual > estimate {
+		color = "\033[31m"
+	}
+	return "[" + color + strings.Repeat("#", filled) + "\033[0m" + strings.Repeat("-", width-filled) + "]"
+}
+
+// uiClip cuts a line to the width of the screen, not counting the escape
+// sequences in it.
+func uiClip(line string, width int) string {
+	var buf strings.Builder
+	n, escape := 0, false
+	for _, r := range line {
+		switch {
+		case escape:
+			escape = r != 'm'
+		case r == '\033':
+			escape = true
+		default:
+			if n >= width {
+				continue
+			}
+			n++
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
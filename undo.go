@@ -15,6 +15,8 @@ func init() {
 
 		flags: flag.NewFlagSet("undo", flag.ExitOnError),
 		run:   undo,
+
+		complete: taskArgs(1),
 	}
 
 	cmd.flags.BoolVar(&undoParams.cmd, "cmd", false, "print annotation as a command")
@@ -31,14 +33,12 @@ func undo(c *command) {
 	if len(args) != 1 {
 		c.Usage(1)
 	}
-	name := args[0]
-
-	task, err := defaultBackend.Load(name)
+	task, err := loadTaskStrictly(c.ctx, args[0])
 	if err != nil {
 		c.Error(err)
 	}
 
-	if err := defaultBackend.PopAnnotation(task); err != nil {
+	if err := defaultBackend.PopAnnotation(c.ctx, task); err != nil {
 		c.Error(err)
 	}
 
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// User is an entry in the user store that serve loads with -users. Token is
+// the hex encoded sha256 of the token the user configures in RPCConfig.
+type User struct {
+	Name  string
+	Token string
+	Admin bool `json:",omitempty"`
+}
+
+// namespacer is implemented by backends that can keep separate tasks and
+// timers for each user.
+type namespacer interface {
+	Namespace(user string) Backend
+}
+
+var validUserName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type userStore struct {
+	users []*User
+	names map[string]*User
+}
+
+// serveUsers is the user store for serve. when it is nil every request
+// operates on defaultBackend without authentication.
+var serveUsers *userStore
+
+func loadUsers(path string) (s *userStore, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s = &userStore{names: map[string]*User{}}
+	if err = json.NewDecoder(f).Decode(&s.users); err != nil {
+		err = fmt.Errorf("error parsing users file: %s", err)
+		return
+	}
+
+	for _, u := range s.users {
+		if !validUserName.MatchString(u.Name) {
+			err = fmt.Errorf("invalid user name: %q", u.Name)
+			return
+		}
+		if _, ok := s.names[u.Name]; ok {
+			err = fmt.Errorf("duplicate user: %q", u.Name)
+			return
+		}
+		if len(u.Token) != sha256.Size*2 {
+			err = fmt.Errorf("user %q: token must be a hex encoded sha256", u.Name)
+			return
+		}
+		s.names[u.Name] = u
+	}
+	return
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate finds the user for the token, comparing against every user so
+// the time taken doesn't reveal which tokens exist.
+func (s *userStore) authenticate(token string) (user *User) {
+	hash := []byte(hashToken(token))
+	for _, u := range s.users {
+		if subtle.ConstantTimeCompare(hash, []byte(u.Token)) == 1 {
+			user = u
+		}
+	}
+	return
+}
+
+// requestUser returns the authenticated user for the request along with the
+// name of the user whose data it operates on. admins may act on the data of
+// any user by naming them in the X-Est-User header.
+func (s *userStore) requestUser(req *http.Request) (user *User, as string, err error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		err = errorf(ErrUnauthorized, "missing api token")
+		return
+	}
+	user = s.authenticate(strings.TrimPrefix(auth, "Bearer "))
+	if user == nil {
+		err = errorf(ErrUnauthorized, "invalid api token")
+		return
+	}
+
+	as = user.Name
+	if other := req.Header.Get("X-Est-User"); other != "" && other != user.Name {
+		if !user.Admin {
+			err = errorf(ErrUnauthorized, "user %q may not act as %q", user.Name, other)
+			return
+		}
+		if _, ok := s.names[other]; !ok {
+			err = errorf(ErrUnauthorized, "unknown user: %q", other)
+			return
+		}
+		as = other
+	}
+	return
+}
+
+// requestBackend returns the backend a request to serve should operate on
+// and the name of the user making it.
+func requestBackend(req *http.Request) (b Backend, name string, err error) {
+	if serveUsers == nil {
+		b = defaultBackend
+		return
+	}
+	user, as, err := serveUsers.requestUser(req)
+	if err != nil {
+		return
+	}
+	name = user.Name
+	b = defaultBackend.(namespacer).Namespace(as)
+	return
+}
+
+//
+// gentoken command: makes tokens for the user store
+//
+
+func init() {
+	cmd := &command{
+		short: "generates an api token for a serve user",
+		long:  "Generates a random api token and prints it along with the entry to add to the users file given to serve. The token goes in the Token field of RPCConfig.",
+		usage: "gentoken [-admin] <user name>",
+
+		needsBackend: false,
+
+		flags: flag.NewFlagSet("gentoken", flag.ExitOnError),
+		run:   gentoken,
+	}
+
+	cmd.flags.BoolVar(&gentokenParams.admin, "admin", false, "give the user the admin role")
+
+	commands["gentoken"] = cmd
+}
+
+var gentokenParams struct {
+	admin bool
+}
+
+func gentoken(c *command) {
+	args := c.flags.Args()
+	if len(args) != 1 {
+		c.Usage(1)
+	}
+	if !validUserName.MatchString(args[0]) {
+		c.Error(fmt.Errorf("invalid user name: %q", args[0]))
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		c.Error(err)
+	}
+	token := hex.EncodeToString(buf)
+
+	entry, _ := json.MarshalIndent(User{
+		Name:  args[0],
+		Token: hashToken(token),
+		Admin: gentokenParams.admin,
+	}, "", "\t")
+
+	fmt.Println("token:", token)
+	fmt.Printf("users file entry:\n%s\n", entry)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func init() {
+	cmd := &command{
+		short: "compares the backends of a mirror",
+		long:  "Compares every task and the timer on each secondary of a mirror backend with the primary, and lists the differences. Exits with status 1 if there are any.",
+		usage: "verify",
+
+		needsBackend: true,
+
+		flags: flag.NewFlagSet("verify", flag.ExitOnError),
+		run:   verify,
+	}
+
+	commands["verify"] = cmd
+}
+
+func verify(c *command) {
+	args := c.flags.Args()
+	if len(args) != 0 {
+		c.Usage(1)
+	}
+
+	b := defaultBackend
+	if o, ok := b.(*offlineBackend); ok {
+		if b = o.remote; b == nil {
+			c.Error(errorf(ErrUnavailable, "the backend is unreachable"))
+		}
+	}
+	m, ok := asMirror(b)
+	if !ok {
+		c.Error(errorf(ErrInvalidArgument, "the %s backend is not a mirror", defaultConfig.Backend))
+	}
+
+	n, err := m.verify(c.ctx, func(backend, task, diff string) {
+		fmt.Printf("%s: %s: %s\n", backend, task, diff)
+	})
+	if err != nil {
+		c.Error(err)
+	}
+
+	//point at the record of what went wrong
+	if f, err := os.Open(m.log); err == nil {
+		lines := 0
+		for s := bufio.NewScanner(f); s.Scan(); {
+			lines++
+		}
+		f.Close()
+		if lines > 0 {
+			fmt.Printf("%d failed writes recorded in %s\n", lines, m.log)
+		}
+	}
+
+	if n > 0 {
+		fmt.Printf("%d differences\n", n)
+		os.Exit(1)
+	}
+	fmt.Println("the backends match")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestVerifyTasksWithoutAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openBackend(&Config{Backend: "mirror", Sections: map[string]interface{}{
+		"MirrorConfig": &MirrorConfig{
+			Primary: &Config{Backend: "bolt", Sections: map[string]interface{}{
+				"BoltConfig": &BoltConfig{Path: filepath.Join(dir, "primary.db")},
+			}},
+			Secondaries: []*Config{{Backend: "sql", Sections: map[string]interface{}{
+				"SQLConfig": &SQLConfig{DSN: filepath.Join(dir, "secondary.sqlite")},
+			}}},
+			Log: filepath.Join(dir, "divergence"),
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := asMirror(b)
+	ctx := context.Background()
+
+	//drift on tasks nobody has worked on yet
+	primary, secondary := m.backends[0], m.backends[1]
+	if err := b.Save(ctx, &Task{Name: "described"}); err != nil {
+		t.Fatal(err)
+	}
+	task, _ := primary.Load(ctx, "described")
+	if err := primary.SetDescription(ctx, task, "only on the primary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.Save(ctx, &Task{Name: "extra"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Save(ctx, &Task{Name: "missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	n, err := m.verify(ctx, func(backend, task, diff string) {
+		found = append(found, task)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	if n != 3 || len(found) != 3 || found[0] != "described" || found[1] != "extra" || found[2] != "missing" {
+		t.Fatalf("%d differences on %q", n, found)
+	}
+}